@@ -0,0 +1,130 @@
+// gracefulctl drives the admin API of a running tus server.
+//
+//	gracefulctl maintenance on [-wait]   stop admitting uploads, -wait returns once idle
+//	gracefulctl maintenance off          admit uploads again
+//	gracefulctl maintenance status       print the maintenance status
+//	gracefulctl resume                   cancel a drain started by mistake
+//
+// The token is read from GRACEFUL_ADMIN_TOKEN unless -token is given.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/app"
+)
+
+func main() {
+	addr := flag.String("addr", "http://127.0.0.1:8180", "base URL of the server")
+	token := flag.String("token", os.Getenv("GRACEFUL_ADMIN_TOKEN"), "bearer token of the admin API")
+	flag.Usage = usage
+	flag.Parse()
+
+	c := &client{addr: strings.TrimSuffix(*addr, "/"), token: *token}
+	if err := run(c, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "gracefulctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gracefulctl [-addr URL] [-token TOKEN] maintenance on [-wait] | maintenance off | maintenance status | resume")
+	flag.PrintDefaults()
+}
+
+func run(c *client, args []string) error {
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing command")
+	}
+	switch args[0] {
+	case "resume":
+		return c.do(http.MethodPost, app.LifecycleResumePath, nil)
+	case "maintenance":
+		return maintenance(c, args[1:])
+	}
+	usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func maintenance(c *client, args []string) error {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	wait := fs.Bool("wait", false, "wait until no upload is running")
+	timeout := fs.Duration("timeout", 0, "bound the wait, zero waits forever")
+	if len(args) == 0 {
+		return errors.New("maintenance: on, off or status")
+	}
+	fs.Parse(args[1:])
+
+	var status app.MaintenanceStatus
+	switch args[0] {
+	case "on":
+		if err := c.do(http.MethodPut, app.AdminMaintenancePath, &status); err != nil {
+			return err
+		}
+	case "off":
+		return c.do(http.MethodDelete, app.AdminMaintenancePath, &status)
+	case "status":
+		return c.do(http.MethodGet, app.AdminMaintenancePath, &status)
+	default:
+		return fmt.Errorf("maintenance: unknown mode %q", args[0])
+	}
+
+	var deadline <-chan time.Time
+	if *timeout > 0 {
+		deadline = time.After(*timeout)
+	}
+	for *wait && !status.Idle {
+		select {
+		case <-deadline:
+			return fmt.Errorf("still running: %s", strings.Join(status.Uploads, ", "))
+		case <-time.After(time.Second):
+		}
+		status = app.MaintenanceStatus{}
+		if err := c.do(http.MethodGet, app.AdminMaintenancePath, &status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type client struct {
+	addr  string
+	token string
+}
+
+// do sends the request, prints the response body and decodes it into v when not nil.
+func (c *client) do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, c.addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", method, path, res.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	if v != nil {
+		return json.Unmarshal(body, v)
+	}
+	return nil
+}
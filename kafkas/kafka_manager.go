@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"sync"
 
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/davidtrse/graceful/pkg/drainctx"
 	"github.com/labstack/gommon/log"
 	"github.com/segmentio/kafka-go"
 )
@@ -19,16 +21,37 @@ var (
 	ErrContextClosed = errors.New("closed. Can not read more message")
 )
 
+// TranscodeKind is the kind of work the transcodes are tracked as.
+const TranscodeKind = "transcode"
+
+// Tracker records the in-flight transcodes, it is satisfied by *app.WorkTracker
+// which cannot be referenced here without an import cycle.
+type Tracker interface {
+	Begin(kind, id string) func()
+	End(kind, id string)
+	Idle(kinds ...string) bool
+	IDs(kind string) []string
+	Wait(ctx context.Context, kinds ...string) error
+}
+
 type IKafkaManager interface {
 	CreateReader()
 	CreateWriter()
 	ReadMessage(topic string) (kafka.Message, error)
+	Requeue(msg kafka.Message)
 	WriteMessage(topic string, key []byte, value []byte) error
 	WriteMessageWithHeader(topic string, key []byte, value []byte, headerName string, headerValue string) error
 	StartNewTranscode(id string)
 	DoneTranscode(id string)
 	IsDone() bool
+	Wait(ctx context.Context) error
+	RunningTranscodes() []string
+	Draining() context.Context
+	HardDeadline() context.Context
+	MessageContext(ctx context.Context) context.Context
+	Abort()
 	Close()
+	Resume()
 	StopReadMessage()
 	StopWriteMessage()
 }
@@ -53,12 +76,22 @@ type KafkaManager struct {
 	// isClosed was setted as soon as receiving terminated signal
 	// Do not read more message if IsClose equal true
 	isClosed bool
-
-	mu sync.Mutex
-	// keepRunning was setted as soon as start new transcode times
-	// and reverted after the new message was processed.
-	// keepRunning be used to check whether can stop transcode service or not
-	keepRunning map[string]bool
+	// closedMu guards isClosed and Context, which Resume replaces.
+	closedMu sync.Mutex
+	// DrainTimeout is when the hard deadline of the message handlers
+	// expires after Close, zero lets it only expire on Abort.
+	DrainTimeout time.Duration
+	ctxs         *drainctx.Contexts
+
+	// pending are the messages to read again before the readers,
+	// e.g. the transcodes interrupted by the previous process.
+	pending   []kafka.Message
+	pendingMu sync.Mutex
+
+	// tracker records a transcode as soon as the message is read
+	// until it is processed, it is used to check whether the
+	// transcode service can be stopped or not.
+	tracker Tracker
 }
 
 func (this *KafkaManager) loadKafkaConfig() error {
@@ -76,10 +109,11 @@ func (this *KafkaManager) loadKafkaConfig() error {
 
 }
 
-func NewKafkaManager(kConfig *KafkaConfig) (*KafkaManager, error) {
+func NewKafkaManager(kConfig *KafkaConfig, tracker Tracker) (*KafkaManager, error) {
 	km := &KafkaManager{
-		Config:      kConfig,
-		keepRunning: map[string]bool{},
+		Config:  kConfig,
+		tracker: tracker,
+		ctxs:    drainctx.New(nil),
 	}
 	err := km.loadKafkaConfig()
 	if err != nil {
@@ -142,12 +176,25 @@ func (this *KafkaManager) ReadMessage(topic string) (kafka.Message, error) {
 		}
 	}()
 
-	if this.isClosed {
+	this.closedMu.Lock()
+	isClosed, ctx := this.isClosed, this.Context
+	this.closedMu.Unlock()
+	if isClosed {
 		return kafka.Message{}, ErrContextClosed
 	}
 
+	this.pendingMu.Lock()
+	if len(this.pending) > 0 {
+		msg := this.pending[0]
+		this.pending = this.pending[1:]
+		this.pendingMu.Unlock()
+		fmt.Printf("ReadMessageByPriority: Got requeued message: %s \n", string(msg.Value))
+		return msg, nil
+	}
+	this.pendingMu.Unlock()
+
 	if topic != "" {
-		msg, err := this.readMessageWithTimeout(this.Context, this.Readers[topic], time.Second*1)
+		msg, err := this.readMessageWithTimeout(ctx, this.Readers[topic], time.Second*1)
 		if err == nil {
 			fmt.Printf("ReadMessageByPriority: Got message from topic: %s \n", topic)
 			return msg, nil
@@ -157,7 +204,7 @@ func (this *KafkaManager) ReadMessage(topic string) (kafka.Message, error) {
 		}
 	} else {
 		for _, topic := range this.Topics {
-			msg, err := this.readMessageWithTimeout(this.Context, this.Readers[topic], time.Second*1)
+			msg, err := this.readMessageWithTimeout(ctx, this.Readers[topic], time.Second*1)
 			fmt.Println("Readed more message")
 			if err == nil {
 				fmt.Printf("ReadMessageByPriority: Got message from topic: %s \n", topic)
@@ -174,6 +221,13 @@ func (this *KafkaManager) ReadMessage(topic string) (kafka.Message, error) {
 	}
 }
 
+// Requeue makes ReadMessage return msg before reading the topics again.
+func (this *KafkaManager) Requeue(msg kafka.Message) {
+	this.pendingMu.Lock()
+	defer this.pendingMu.Unlock()
+	this.pending = append(this.pending, msg)
+}
+
 func (this *KafkaManager) WriteMessage(topic string, key []byte, value []byte) error {
 	defer func() {
 		if err := recover(); err != nil {
@@ -214,29 +268,69 @@ func (this *KafkaManager) StopReadMessage() {
 }
 
 func (this *KafkaManager) Close() {
+	this.ctxs.StartDrain(this.DrainTimeout)
+	this.closedMu.Lock()
+	defer this.closedMu.Unlock()
 	this.isClosed = true
 	this.CancelFunc()
 }
 
-func (this *KafkaManager) StartNewTranscode(id string) {
-	this.mu.Lock()
-	defer this.mu.Unlock()
+// Resume undoes Close when the drain is canceled, the readers read again and
+// the messages read from now on get new draining and hard deadline contexts.
+func (this *KafkaManager) Resume() {
+	this.ctxs.Reset()
+	this.closedMu.Lock()
+	defer this.closedMu.Unlock()
+	this.Context, this.CancelFunc = context.WithCancel(context.Background())
+	this.isClosed = false
+}
 
-	this.keepRunning[id] = true
+// SetClock measures DrainTimeout on c, it must be called before the messages are read.
+func (this *KafkaManager) SetClock(c clock.Clock) {
+	this.ctxs = drainctx.New(c)
 }
 
-func (this *KafkaManager) DoneTranscode(id string) {
-	this.mu.Lock()
-	defer this.mu.Unlock()
+// Draining is done as soon as Close is called.
+func (this *KafkaManager) Draining() context.Context {
+	return this.ctxs.Draining()
+}
 
-	delete(this.keepRunning, id)
+// HardDeadline is done when the drain is cut off, by DrainTimeout or by Abort.
+func (this *KafkaManager) HardDeadline() context.Context {
+	return this.ctxs.HardDeadline()
+}
+
+// MessageContext returns the context to handle a message with, see
+// drainctx.Draining and drainctx.HardDeadline.
+func (this *KafkaManager) MessageContext(ctx context.Context) context.Context {
+	return drainctx.With(ctx, this.ctxs)
+}
+
+// Abort cancels HardDeadline, the message handlers still running must stop right away.
+func (this *KafkaManager) Abort() {
+	this.ctxs.Abort()
+}
+
+func (this *KafkaManager) StartNewTranscode(id string) {
+	this.tracker.Begin(TranscodeKind, id)
+}
+
+func (this *KafkaManager) DoneTranscode(id string) {
+	this.tracker.End(TranscodeKind, id)
 }
 
 func (this *KafkaManager) IsDone() bool {
-	this.mu.Lock()
-	defer this.mu.Unlock()
+	return this.tracker.Idle(TranscodeKind)
+}
+
+// RunningTranscodes returns the sorted IDs of the transcodes which are not done yet.
+func (this *KafkaManager) RunningTranscodes() []string {
+	return this.tracker.IDs(TranscodeKind)
+}
 
-	return len(this.keepRunning) == 0
+// Wait blocks until no transcode is running or ctx is done.
+func (this *KafkaManager) Wait(ctx context.Context) error {
+	return this.tracker.Wait(ctx, TranscodeKind)
 }
 
 func logf(msg string, a ...interface{}) {
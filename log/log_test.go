@@ -13,3 +13,16 @@ func TestPrintln(t *testing.T) {
 
 	Info("Hey!", zap.String("foo", "bar"), zap.Int("hello", 2))
 }
+
+func TestReopenClosesTheOldSinks(t *testing.T) {
+	old := loggers()
+	closed := false
+	current.Store(&zapLoggers{config: old.config, logger: old.logger, sugar: old.sugar, close: func() { closed = true }})
+	if err := Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed {
+		t.Error("Reopen kept the sinks of the old logger open")
+	}
+	Infof("logged after %s", "Reopen")
+}
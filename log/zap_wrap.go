@@ -4,15 +4,28 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-var (
-	logger      *zap.Logger
-	sugarLogger *zap.SugaredLogger
-)
+// zapLoggers are swapped as a whole by Reopen while the others log.
+type zapLoggers struct {
+	config *ZapConfig
+	logger *zap.Logger
+	sugar  *zap.SugaredLogger
+	// close closes the sinks of logger, the files it writes to.
+	close func()
+}
+
+var current atomic.Value
+
+func loggers() *zapLoggers {
+	return current.Load().(*zapLoggers)
+}
 
 var CLIENT_ERROR = "CLIENT_ERROR"
 var SERVER_ERROR = "SERVER_ERROR"
@@ -24,19 +37,66 @@ func init() {
 func Init(zc *ZapConfig) {
 	fmt.Println("Init Zap logger")
 
-	var err error
-	zapConfig := CreateZapConfig(zc)
-
-	logger, err = zapConfig.Build(zap.AddCallerSkip(1))
-	if err != nil {
+	if err := build(zc); err != nil {
 		log.Fatal("Creating Zap Logger error.")
 	}
-	sugarLogger = logger.Sugar()
+}
 
-	defer func() {
-		_ = logger.Sync()
-		_ = sugarLogger.Sync()
-	}()
+// Reopen builds the logger again from the config of Init, the log files
+// moved away by a rotation are created again and the old ones are closed.
+func Reopen() error {
+	old := loggers()
+	if err := build(old.config); err != nil {
+		return err
+	}
+	_ = old.logger.Sync()
+	old.close()
+	return nil
+}
+
+// build opens the sinks itself, zap.Config.Build does not tell how to close
+// the ones it opens.
+func build(zc *ZapConfig) error {
+	zapConfig := CreateZapConfig(zc)
+	sink, closeSink, err := zap.Open(zapConfig.OutputPaths...)
+	if err != nil {
+		return err
+	}
+	errSink, closeErrSink, err := zap.Open(zapConfig.ErrorOutputPaths...)
+	if err != nil {
+		closeSink()
+		return err
+	}
+	encoder := zapcore.NewConsoleEncoder(zapConfig.EncoderConfig)
+	if zapConfig.Encoding == "json" {
+		encoder = zapcore.NewJSONEncoder(zapConfig.EncoderConfig)
+	}
+	core := zapcore.NewCore(encoder, sink, zapConfig.Level)
+	if s := zapConfig.Sampling; s != nil {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, s.Initial, s.Thereafter)
+	}
+	// Build keeps the options of the config and opens no sink without paths.
+	zapConfig.OutputPaths, zapConfig.ErrorOutputPaths = nil, nil
+	logger, err := zapConfig.Build(
+		zap.AddCallerSkip(1),
+		zap.ErrorOutput(errSink),
+		zap.WrapCore(func(zapcore.Core) zapcore.Core { return core }),
+	)
+	if err != nil {
+		closeSink()
+		closeErrSink()
+		return err
+	}
+	current.Store(&zapLoggers{
+		config: zc,
+		logger: logger,
+		sugar:  logger.Sugar(),
+		close: func() {
+			closeSink()
+			closeErrSink()
+		},
+	})
+	return nil
 }
 
 func CreateZapConfig(zc *ZapConfig) *zap.Config {
@@ -60,68 +120,74 @@ func CreateZapConfig(zc *ZapConfig) *zap.Config {
 	return &zapConfig
 }
 
+// Sync flushes any buffered log entries.
+func Sync() {
+	_ = loggers().logger.Sync()
+	_ = loggers().sugar.Sync()
+}
+
 func Info(msg string, fields ...zap.Field) {
-	logger.Info(msg, fields...)
+	loggers().logger.Info(msg, fields...)
 }
 
 func Infof(msg string, args ...interface{}) {
-	sugarLogger.Infof(msg, args...)
+	loggers().sugar.Infof(msg, args...)
 }
 
 func Infoff(ctx context.Context, msg string, args ...interface{}) {
 	tracing := fmt.Sprintf(" trace_id=%s", trace.SpanFromContext(ctx).SpanContext().TraceID())
 	msg = msg + tracing
-	sugarLogger.Infof(msg, args...)
+	loggers().sugar.Infof(msg, args...)
 }
 
 func Debug(msg string, fields ...zap.Field) {
-	logger.Debug(msg, fields...)
+	loggers().logger.Debug(msg, fields...)
 }
 
 func Debugf(msg string, args ...interface{}) {
-	sugarLogger.Debugf(msg, args...)
+	loggers().sugar.Debugf(msg, args...)
 }
 
 func Warnf(msg string, args ...interface{}) {
-	sugarLogger.Warnf(msg, args...)
+	loggers().sugar.Warnf(msg, args...)
 }
 
 func Error(msg string, fields ...zap.Field) {
-	logger.Error(msg, fields...)
+	loggers().logger.Error(msg, fields...)
 }
 
 func Errorf(msg string, args ...interface{}) {
-	sugarLogger.Errorf(msg, args...)
+	loggers().sugar.Errorf(msg, args...)
 }
 
 func Fatal(msg string, fields ...zap.Field) {
-	logger.Fatal(msg, fields...)
+	loggers().logger.Fatal(msg, fields...)
 }
 
 func Fatalf(msg string, args ...interface{}) {
-	sugarLogger.Fatalf(msg, args...)
+	loggers().sugar.Fatalf(msg, args...)
 }
 
 func Panic(msg string, fields ...zap.Field) {
-	logger.Panic(msg, fields...)
+	loggers().logger.Panic(msg, fields...)
 }
 
 func Panicf(msg string, args ...interface{}) {
-	sugarLogger.Panicf(msg, args...)
+	loggers().sugar.Panicf(msg, args...)
 }
 
 func Print(msg string, fields ...zap.Field) {
-	logger.Info(msg, fields...)
+	loggers().logger.Info(msg, fields...)
 }
 
 func Printf(msg string, args ...interface{}) {
-	sugarLogger.Infof(msg, args...)
+	loggers().sugar.Infof(msg, args...)
 }
 
 func Println(msg string, fields ...zap.Field) {
-	logger.Info(msg, fields...)
+	loggers().logger.Info(msg, fields...)
 }
 
 func Printlnf(msg string, args ...interface{}) {
-	sugarLogger.Infof(msg, args...)
+	loggers().sugar.Infof(msg, args...)
 }
@@ -1,8 +1,13 @@
 package main
 
-import "github.com/davidtrse/graceful/tus"
+import (
+	"os"
+
+	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/tus"
+)
 
 func main() {
-	// server.Kafka()
-	tus.Run()
+	// os.Exit(app.ExitCode(server.Kafka()))
+	os.Exit(app.ExitCode(tus.Run()))
 }
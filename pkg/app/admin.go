@@ -0,0 +1,95 @@
+package app
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	AdminPath            = "/admin"
+	AdminMaintenancePath = AdminPath + "/maintenance"
+)
+
+// IsAdminPath reports whether path is served by RegisterAdminHandlers.
+func IsAdminPath(path string) bool {
+	return path == AdminPath || strings.HasPrefix(path, AdminPath+"/")
+}
+
+// AdminAuth admits the requests carrying "Authorization: Bearer <token>",
+// the others get 401.
+func AdminAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			got := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="admin"`)
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// MaintenanceStatus is served on AdminMaintenancePath.
+type MaintenanceStatus struct {
+	Maintenance bool       `json:"maintenance"`
+	Since       *time.Time `json:"since,omitempty"`
+	Draining    bool       `json:"draining"`
+	// Idle is true once no upload is running anymore and no request holds
+	// the lock of one, the stale uploads aside, the upload directory can
+	// then be worked on.
+	Idle    bool     `json:"idle"`
+	Uploads []string `json:"uploads"`
+}
+
+func maintenanceStatus(m GracefulTUSManager) MaintenanceStatus {
+	uploads := m.RunningUploads()
+	status := MaintenanceStatus{
+		Draining: !m.DrainStartedAt().IsZero(),
+		Idle:     m.CanShutdown(),
+		Uploads:  uploads,
+	}
+	if since := m.MaintenanceSince(); !since.IsZero() {
+		status.Maintenance = true
+		status.Since = &since
+	}
+	return status
+}
+
+// RegisterAdminHandlers serves the maintenance mode of m behind auth:
+// GET reports it, PUT enters it and DELETE leaves it. Changing it during
+// a drain answers 409.
+func RegisterAdminHandlers(e *echo.Echo, m GracefulTUSManager, auth echo.MiddlewareFunc) {
+	g := e.Group(AdminPath, auth)
+	g.GET("/maintenance", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, maintenanceStatus(m))
+	})
+	g.PUT("/maintenance", func(c echo.Context) error {
+		if err := m.EnterMaintenance(); err != nil {
+			return maintenanceError(c, err)
+		}
+		log.Infof("admin: maintenance entered by %s", c.RealIP())
+		return c.JSON(http.StatusOK, maintenanceStatus(m))
+	})
+	g.DELETE("/maintenance", func(c echo.Context) error {
+		if err := m.ExitMaintenance(); err != nil {
+			return maintenanceError(c, err)
+		}
+		log.Infof("admin: maintenance left by %s", c.RealIP())
+		return c.JSON(http.StatusOK, maintenanceStatus(m))
+	})
+}
+
+func maintenanceError(c echo.Context, err error) error {
+	code := http.StatusInternalServerError
+	if errors.Is(err, ErrDraining) {
+		code = http.StatusConflict
+	}
+	return c.JSON(code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestMaintenance(t *testing.T) {
+	tracker := NewWorkTracker()
+	m := NewShutdownManage(WithTracker(tracker))
+	e := echo.New()
+	e.Use(m.EchoMiddleware())
+	RegisterHealthHandlers(e, &Context{GracefulTUSManager: m, Tracker: tracker})
+	RegisterAdminHandlers(e, m, AdminAuth("secret"))
+	e.GET("/files/:fileID", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.POST("/files", func(c echo.Context) error { return c.NoContent(http.StatusCreated) })
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	status := func(rec *httptest.ResponseRecorder) MaintenanceStatus {
+		var s MaintenanceStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	m.StartReceivingRequest()
+	m.StartNewUpload("upload-1")
+	for _, token := range []string{"", "wrong"} {
+		if rec := do(http.MethodPut, AdminMaintenancePath, token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("PUT with token %q = %d, want %d", token, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if !m.MaintenanceSince().IsZero() {
+		t.Fatal("an unauthorized request entered the maintenance")
+	}
+
+	rec := do(http.MethodPut, AdminMaintenancePath, "secret")
+	if s := status(rec); rec.Code != http.StatusOK || !s.Maintenance || s.Idle {
+		t.Fatalf("PUT = %d %+v, want maintenance with upload-1 running", rec.Code, s)
+	}
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/files", http.StatusServiceUnavailable},
+		{http.MethodGet, "/files/upload-2", http.StatusOK},
+		{http.MethodGet, ReadyzPath, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.method, tt.path, ""); rec.Code != tt.want {
+			t.Errorf("%s %s in maintenance = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+	if m.Draining().Err() != nil {
+		t.Error("the maintenance started the drain")
+	}
+
+	// A drain canceled in maintenance goes back to it.
+	m.StopReceivingRequest()
+	m.StartReceivingRequest()
+	if m.MaintenanceSince().IsZero() || m.IsReceivingRequest() {
+		t.Error("the canceled drain left the maintenance")
+	}
+
+	// A request holding the lock of an upload keeps the node busy.
+	m.DoneUpload("upload-1")
+	m.LockUpload("upload-2")
+	if s := status(do(http.MethodGet, AdminMaintenancePath, "secret")); s.Idle {
+		t.Errorf("GET = %+v, want busy with the lock of upload-2", s)
+	}
+	m.UnlockUpload("upload-2")
+	if s := status(do(http.MethodGet, AdminMaintenancePath, "secret")); !s.Idle {
+		t.Errorf("GET = %+v, want idle", s)
+	}
+	if rec := do(http.MethodDelete, AdminMaintenancePath, "secret"); rec.Code != http.StatusOK || status(rec).Maintenance {
+		t.Errorf("DELETE = %d, want out of maintenance", rec.Code)
+	}
+	if !m.IsReceivingRequest() {
+		t.Error("not receiving after the maintenance")
+	}
+
+	m.StopReceivingRequest()
+	if rec := do(http.MethodPut, AdminMaintenancePath, "secret"); rec.Code != http.StatusConflict {
+		t.Errorf("PUT while draining = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdmissionAction decides whether a request is admitted while the manager is draining.
+// Every action admits the requests while the manager is receiving.
+type AdmissionAction int
+
+const (
+	// AdmitAlways admits the request during the drain too, e.g. the probes.
+	AdmitAlways AdmissionAction = iota
+	// AdmitExistingUpload admits the request during the drain only when its
+	// fileID is an upload which is still tracked, e.g. tus PATCH and HEAD.
+	AdmitExistingUpload
+	// RejectDuringDrain rejects the request as soon as the drain starts, e.g. tus POST.
+	RejectDuringDrain
+	// RejectAfterDeadline admits the request during the drain until the drain
+	// deadline is over, e.g. downloads.
+	RejectAfterDeadline
+)
+
+// AdmissionRule applies Action to the requests matching Method and Path.
+type AdmissionRule struct {
+	// Method is the HTTP method, empty matches every method.
+	Method string
+	// Path is the echo route, e.g. "/files/:fileID". A path ending with "*"
+	// matches the whole group, e.g. "/admin/*".
+	Path   string
+	Action AdmissionAction
+}
+
+func (r AdmissionRule) matches(method, path string) bool {
+	if r.Method != "" && r.Method != method {
+		return false
+	}
+	if prefix := strings.TrimSuffix(r.Path, "*"); prefix != r.Path {
+		return strings.HasPrefix(path, prefix)
+	}
+	return r.Path == path
+}
+
+// AdmissionPolicy is evaluated rule by rule, the first matching rule wins
+// and Default applies to the unmatched routes.
+type AdmissionPolicy struct {
+	Rules   []AdmissionRule
+	Default AdmissionAction
+}
+
+// Action returns the action applying to a request on the echo route path.
+func (p AdmissionPolicy) Action(method, path string) AdmissionAction {
+	for _, r := range p.Rules {
+		if r.matches(method, path) {
+			return r.Action
+		}
+	}
+	return p.Default
+}
+
+// DefaultAdmissionPolicy serves the probes, the lifecycle and admin endpoints
+// and the running uploads during the drain, lets downloads go on until the deadline and rejects the rest.
+func DefaultAdmissionPolicy() AdmissionPolicy {
+	return AdmissionPolicy{
+		Rules: []AdmissionRule{
+			{Path: HealthzPath, Action: AdmitAlways},
+			{Path: ReadyzPath, Action: AdmitAlways},
+			{Path: DrainzPath, Action: AdmitAlways},
+			{Path: MetricsPath, Action: AdmitAlways},
+			// The deploy tooling follows the drain on the event stream.
+			{Path: EventsPath, Action: AdmitAlways},
+			// The drain is canceled through the lifecycle endpoints.
+			{Path: LifecyclePath + "*", Action: AdmitAlways},
+			{Path: AdminPath + "/*", Action: AdmitAlways},
+			// Browsers send a preflight before PATCHing a running upload.
+			{Method: http.MethodOptions, Path: "/" + tusEndpoint + "*", Action: AdmitAlways},
+			{Method: http.MethodPost, Path: "/" + tusEndpoint, Action: RejectDuringDrain},
+			{Method: http.MethodHead, Path: "/" + tusEndpoint + "/:" + tusParam, Action: AdmitExistingUpload},
+			{Method: http.MethodPatch, Path: "/" + tusEndpoint + "/:" + tusParam, Action: AdmitExistingUpload},
+			// Terminating a running upload lets the drain end sooner.
+			{Method: http.MethodDelete, Path: "/" + tusEndpoint + "/:" + tusParam, Action: AdmitExistingUpload},
+			{Method: http.MethodGet, Path: "/" + tusEndpoint + "/:" + tusParam, Action: RejectAfterDeadline},
+		},
+		Default: RejectDuringDrain,
+	}
+}
+
+// CanReceiveRequest applies the admission policy to a request on the echo
+// route path, fileID is the tus upload ID of the request if any.
+func (s *GracefulManager) CanReceiveRequest(method, path, fileID string) bool {
+	s.mu.Lock()
+	receiving := s.acceptRequest
+	deadline := time.Time{}
+	if s.drainTimeout > 0 && !s.drainStartedAt.IsZero() {
+		deadline = s.drainStartedAt.Add(s.drainTimeout)
+	}
+	policy := s.policy
+	now := s.clock.Now()
+	s.mu.Unlock()
+
+	if receiving {
+		return true
+	}
+
+	switch policy.Action(method, path) {
+	case AdmitAlways:
+		return true
+	case AdmitExistingUpload:
+		return fileID != "" && s.tracker.Has(KindUpload, fileID)
+	case RejectAfterDeadline:
+		return deadline.IsZero() || now.Before(deadline)
+	}
+	return false
+}
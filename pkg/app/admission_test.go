@@ -0,0 +1,65 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDefaultAdmissionPolicyDuringDrain(t *testing.T) {
+	m := NewShutdownManage(WithDrainTimeout(time.Hour)).(*GracefulManager)
+	m.StartReceivingRequest()
+	m.StartNewUpload("running")
+	m.StopReceivingRequest()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		fileID string
+		want   bool
+	}{
+		{"probe", http.MethodGet, ReadyzPath, "", true},
+		{"create upload", http.MethodPost, "/files", "", false},
+		{"patch running upload", http.MethodPatch, "/files/:fileID", "running", true},
+		{"head running upload", http.MethodHead, "/files/:fileID", "running", true},
+		{"patch unknown upload", http.MethodPatch, "/files/:fileID", "unknown", false},
+		{"delete running upload", http.MethodDelete, "/files/:fileID", "running", true},
+		{"delete unknown upload", http.MethodDelete, "/files/:fileID", "unknown", false},
+		{"download before deadline", http.MethodGet, "/files/:fileID", "done", true},
+		{"unmatched route", http.MethodGet, "/filesystem", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.CanReceiveRequest(tt.method, tt.path, tt.fileID); got != tt.want {
+				t.Errorf("CanReceiveRequest(%s %s %q) = %v, want %v", tt.method, tt.path, tt.fileID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectAfterDeadline(t *testing.T) {
+	m := NewShutdownManage(WithDrainTimeout(time.Nanosecond)).(*GracefulManager)
+	m.StartReceivingRequest()
+	if !m.CanReceiveRequest(http.MethodGet, "/files/:fileID", "done") {
+		t.Fatal("download rejected while receiving")
+	}
+	m.StopReceivingRequest()
+	time.Sleep(time.Millisecond)
+	if m.CanReceiveRequest(http.MethodGet, "/files/:fileID", "done") {
+		t.Error("download admitted after the drain deadline")
+	}
+}
+
+func TestAdmissionRuleGroup(t *testing.T) {
+	p := AdmissionPolicy{
+		Rules:   []AdmissionRule{{Path: "/admin/*", Action: AdmitAlways}},
+		Default: RejectDuringDrain,
+	}
+	if got := p.Action(http.MethodPost, "/admin/maintenance"); got != AdmitAlways {
+		t.Errorf("group rule action = %v, want %v", got, AdmitAlways)
+	}
+	if got := p.Action(http.MethodPost, "/administrator"); got != RejectDuringDrain {
+		t.Errorf("default action = %v, want %v", got, RejectDuringDrain)
+	}
+}
@@ -2,9 +2,13 @@ package app
 
 import "github.com/davidtrse/graceful/kafkas"
 
-var Instance *Context
-
+// Context holds the managers a server runs with, it is handed to the
+// constructors of the servers.
 type Context struct {
 	KafkaManager       kafkas.IKafkaManager
 	GracefulTUSManager GracefulTUSManager
+	// Tracker is shared by the managers and the request middleware.
+	Tracker *WorkTracker
+	// Events receives the lifecycle events and the work begun and finished.
+	Events *EventBus
 }
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Labels of the uploads of the concatenation extension.
+const (
+	// ConcatLabel is "awaiting_final" on a complete partial upload and
+	// "final" on a final upload.
+	ConcatLabel = "concat"
+	// FinalLabel is the final upload a partial upload is concatenated into.
+	FinalLabel = "final"
+)
+
+// AwaitFinalUpload keeps the complete partial upload id blocking the drain
+// until the final upload concatenating it is done, the client creates the
+// final upload once every part is complete.
+func (s *GracefulManager) AwaitFinalUpload(id string) {
+	s.tracker.SetLabel(KindUpload, id, ConcatLabel, "awaiting_final")
+}
+
+// StartFinalUpload records the final upload id concatenating parts, the
+// parts are its children and end with it, see DoneUpload.
+func (s *GracefulManager) StartFinalUpload(id string, parts []string) {
+	s.tracker.Begin(KindUpload, id)
+	s.tracker.SetLabel(KindUpload, id, ConcatLabel, "final")
+	for _, part := range parts {
+		s.tracker.SetLabel(KindUpload, part, FinalLabel, id)
+	}
+	s.mu.Lock()
+	s.parts[id] = parts
+	s.mu.Unlock()
+}
+
+// AdmitFinalUpload decides on a final upload concatenating parts. It is
+// admitted during the drain when every part is still tracked, the drain
+// waits for it.
+func (s *GracefulManager) AdmitFinalUpload(remoteAddr, requestURI string, parts []string) *Rejection {
+	if s.IsReceivingRequest() || s.tracksParts(parts) {
+		return nil
+	}
+	rej := s.RejectionConfig().NewRejection(remoteAddr, requestURI)
+	s.metrics.Rejected(ReasonDraining)
+	return &rej
+}
+
+func (s *GracefulManager) tracksParts(parts []string) bool {
+	for _, part := range parts {
+		if !s.tracker.Has(KindUpload, part) {
+			return false
+		}
+	}
+	return len(parts) > 0
+}
+
+// admitsFinalUpload reports whether c creates a final upload whose parts are
+// all tracked, it goes through the drain like the running uploads.
+func (s *GracefulManager) admitsFinalUpload(c echo.Context) bool {
+	if c.Request().Method != http.MethodPost || c.Path() != "/"+tusEndpoint {
+		return false
+	}
+	return s.tracksParts(finalUploadParts(c.Request().Header.Get("Upload-Concat")))
+}
+
+// finalUploadParts returns the IDs of the partial uploads of the
+// Upload-Concat header of a final upload, "final;/files/a /files/b".
+func finalUploadParts(header string) []string {
+	urls := strings.TrimPrefix(header, "final;")
+	if urls == header {
+		return nil
+	}
+	var parts []string
+	for _, url := range strings.Fields(urls) {
+		parts = append(parts, path.Base(url))
+	}
+	return parts
+}
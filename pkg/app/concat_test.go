@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFinalUploadParts(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{header: "", want: nil},
+		{header: "partial", want: nil},
+		{header: "final;/files/a http://peer/files/b", want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := finalUploadParts(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("finalUploadParts(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestFinalUploadEndsItsParts(t *testing.T) {
+	m := NewShutdownManage()
+	m.StartNewUpload("part-1")
+	m.StartNewUpload("part-2")
+	m.AwaitFinalUpload("part-1")
+	m.AwaitFinalUpload("part-2")
+	m.StopReceivingRequest()
+
+	// The complete parts wait for their final upload.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait with the parts awaiting their final upload = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if rej := m.AdmitFinalUpload("", "/files", []string{"part-1", "unknown"}); rej == nil {
+		t.Error("final upload of an unknown part admitted during the drain")
+	}
+	if rej := m.AdmitFinalUpload("", "/files", []string{"part-1", "part-2"}); rej != nil {
+		t.Fatalf("final upload rejected during the drain: %+v", rej)
+	}
+
+	m.StartFinalUpload("final", []string{"part-1", "part-2"})
+	if got, want := m.RunningUploads(), []string{"final", "part-1", "part-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RunningUploads = %v, want %v", got, want)
+	}
+	m.DoneUpload("final")
+	if !m.CanShutdown() {
+		t.Errorf("CanShutdown = false after the final upload, running %v", m.RunningUploads())
+	}
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	_ "github.com/lib/pq"
+)
+
+// DrainCoordinator limits the nodes of a cluster draining at once.
+type DrainCoordinator interface {
+	// Acquire blocks until the node may drain or ctx is done, release
+	// gives the slot back.
+	Acquire(ctx context.Context) (release func() error, err error)
+}
+
+// coordinatorPoll is how often the lock based coordinators try again.
+const coordinatorPoll = time.Second
+
+// NewDrainCoordinator returns the coordinator of uri with slots nodes
+// draining at once: "file:///shared/dir" for FileCoordinator or a
+// "postgres://" URL for PostgresCoordinator. An empty uri returns nil.
+func NewDrainCoordinator(uri string, slots int) (DrainCoordinator, error) {
+	if uri == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return &FileCoordinator{Dir: u.Path, Slots: slots}, nil
+	case "postgres", "postgresql":
+		db, err := sql.Open("postgres", uri)
+		if err != nil {
+			return nil, err
+		}
+		return &PostgresCoordinator{DB: db, Slots: slots}, nil
+	}
+	return nil, fmt.Errorf("drain coordinator %q: unknown scheme", u.Scheme)
+}
+
+// queue waits in StateQueued for the Coordinator to let the node drain. It
+// returns false when CancelDrain canceled the wait. An upgrade and Force skip
+// the queue, as does a failing coordinator: the node drains anyway.
+func (l *Lifecycle) queue(ctx context.Context) (func(), bool) {
+	noop := func() {}
+	queueCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l.mu.Lock()
+	if l.Coordinator == nil || l.state != StateServing || l.upgrading || l.forced {
+		l.mu.Unlock()
+		return noop, true
+	}
+	l.forceDrain = cancel
+	l.mu.Unlock()
+
+	l.setState(StateQueued)
+	release, err := l.Coordinator.Acquire(queueCtx)
+	l.mu.Lock()
+	l.forceDrain = nil
+	canceled, forced := l.canceled, l.forced
+	l.mu.Unlock()
+	if err != nil {
+		if canceled {
+			return nil, false
+		}
+		if !forced {
+			log.Errorf("lifecycle: no drain slot, draining anyway, err=%s", err)
+		}
+		return noop, true
+	}
+	if canceled {
+		if err := release(); err != nil {
+			log.Errorf("lifecycle: release the drain slot, err=%s", err)
+		}
+		return nil, false
+	}
+	return func() {
+		if err := release(); err != nil {
+			log.Errorf("lifecycle: release the drain slot, err=%s", err)
+		}
+	}, true
+}
+
+// MemoryCoordinator shares its slots between the lifecycles of a process,
+// it lets the tests run several servers side by side.
+type MemoryCoordinator struct {
+	slots chan struct{}
+}
+
+func NewMemoryCoordinator(slots int) *MemoryCoordinator {
+	return &MemoryCoordinator{slots: make(chan struct{}, slots)}
+}
+
+func (c *MemoryCoordinator) Acquire(ctx context.Context) (func() error, error) {
+	select {
+	case c.slots <- struct{}{}:
+		var once sync.Once
+		return func() error {
+			once.Do(func() { <-c.slots })
+			return nil
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// FileCoordinator holds a flock on one of the Slots files of Dir, a
+// directory shared by the nodes. The kernel drops the lock of a node which
+// dies.
+type FileCoordinator struct {
+	Dir   string
+	Slots int
+	// Poll defaults to one second.
+	Poll time.Duration
+}
+
+func (c *FileCoordinator) Acquire(ctx context.Context) (func() error, error) {
+	for {
+		for i := 0; i < slotCount(c.Slots); i++ {
+			f, err := os.OpenFile(filepath.Join(c.Dir, fmt.Sprintf("drain-%d.lock", i)), os.O_CREATE|os.O_RDWR, 0o644)
+			if err != nil {
+				return nil, err
+			}
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				// Tell the operators who holds the slot.
+				host, _ := os.Hostname()
+				f.Truncate(0)
+				fmt.Fprintf(f, "%s %d\n", host, os.Getpid())
+				return func() error {
+					syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+					return f.Close()
+				}, nil
+			}
+			f.Close()
+			if !errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, err
+			}
+		}
+		if err := sleepCtx(ctx, c.Poll); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// PostgresCoordinator holds a session advisory lock (Key, slot) on one of
+// Slots slots. The lock is released with the connection of a node which dies.
+type PostgresCoordinator struct {
+	DB    *sql.DB
+	Key   int32
+	Slots int
+	// Poll defaults to one second.
+	Poll time.Duration
+}
+
+func (c *PostgresCoordinator) Acquire(ctx context.Context) (func() error, error) {
+	// The advisory locks belong to the session, the slot is held on a
+	// connection of its own.
+	conn, err := c.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for i := 0; i < slotCount(c.Slots); i++ {
+			var locked bool
+			err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, $2)", c.Key, i).Scan(&locked)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if locked {
+				slot := i
+				return func() error {
+					_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, $2)", c.Key, slot)
+					if closeErr := conn.Close(); err == nil {
+						err = closeErr
+					}
+					return err
+				}, nil
+			}
+		}
+		if err := sleepCtx(ctx, c.Poll); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+}
+
+// slotCount is slots, at least one.
+func slotCount(slots int) int {
+	if slots < 1 {
+		return 1
+	}
+	return slots
+}
+
+// sleepCtx waits for d, coordinatorPoll when zero, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		d = coordinatorPoll
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
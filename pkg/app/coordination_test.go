@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// testSlots checks that c lets one node drain at once.
+func testSlots(t *testing.T, c DrainCoordinator) {
+	release, err := c.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire with the slot held = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	release, err = c.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire after the release = %v", err)
+	}
+	release()
+}
+
+func TestMemoryCoordinator(t *testing.T) {
+	testSlots(t, NewMemoryCoordinator(1))
+}
+
+func TestFileCoordinator(t *testing.T) {
+	testSlots(t, &FileCoordinator{Dir: t.TempDir(), Slots: 1, Poll: 10 * time.Millisecond})
+}
+
+// TestPostgresCoordinator runs against the database of GRACEFUL_TEST_POSTGRES,
+// e.g. postgres://postgres@localhost/postgres?sslmode=disable.
+func TestPostgresCoordinator(t *testing.T) {
+	dsn := os.Getenv("GRACEFUL_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("GRACEFUL_TEST_POSTGRES is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testSlots(t, &PostgresCoordinator{DB: db, Key: 4242, Slots: 1, Poll: 10 * time.Millisecond})
+}
+
+func TestNewDrainCoordinator(t *testing.T) {
+	if c, err := NewDrainCoordinator("", 1); c != nil || err != nil {
+		t.Errorf("NewDrainCoordinator(\"\") = %v, %v, want nil", c, err)
+	}
+	c, err := NewDrainCoordinator("file:///shared/drain", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc, ok := c.(*FileCoordinator); !ok || fc.Dir != "/shared/drain" || fc.Slots != 2 {
+		t.Errorf("NewDrainCoordinator(file) = %#v", c)
+	}
+	if _, err := NewDrainCoordinator("redis://localhost", 1); err == nil {
+		t.Error("NewDrainCoordinator(redis) succeeded")
+	}
+}
+
+func TestLifecycleQueued(t *testing.T) {
+	coordinator := NewMemoryCoordinator(1)
+	newLifecycle := func(hooks ...Hook) (*Lifecycle, <-chan State) {
+		lc := NewLifecycle()
+		lc.Coordinator = coordinator
+		states := make(chan State, 16)
+		lc.OnTransition(func(from, to State) {
+			states <- to
+		})
+		lc.Append(hooks...)
+		if err := lc.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return lc, states
+	}
+	waitState := func(states <-chan State, want State) {
+		t.Helper()
+		for {
+			select {
+			case s := <-states:
+				if s == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no transition to %s", want)
+			}
+		}
+	}
+
+	drained := make(chan struct{})
+	first, firstStates := newLifecycle(blockingDrain(drained))
+	var calls []string
+	second, secondStates := newLifecycle(recordHook(&calls, "admission", PhaseStopAdmission))
+
+	firstDone := make(chan error, 1)
+	go func() { firstDone <- first.Stop(context.Background()) }()
+	waitState(firstStates, StateDraining)
+
+	secondDone := make(chan error, 1)
+	go func() { secondDone <- second.Stop(context.Background()) }()
+	waitState(secondStates, StateQueued)
+	if err := second.CancelDrain(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-secondDone; !errors.Is(err, ErrDrainCanceled) {
+		t.Fatalf("Stop of the queued lifecycle = %v, want %v", err, ErrDrainCanceled)
+	}
+	if len(calls) != 1 {
+		t.Errorf("calls = %v, want only the start, the queued drain stops no hook", calls)
+	}
+
+	go func() { secondDone <- second.Stop(context.Background()) }()
+	waitState(secondStates, StateQueued)
+	close(drained)
+	if err := <-firstDone; err != nil {
+		t.Fatal(err)
+	}
+	waitState(secondStates, StateDraining)
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+)
+
+// EnvDuration reads a time.ParseDuration value such as "30s" from the
+// environment variable key, def is returned when it is unset or invalid.
+func EnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Errorf("invalid %s=%q, using %s, err=%s", key, v, def, err)
+		return def
+	}
+	return d
+}
+
+// EnvList reads a comma separated list from the environment variable key.
+func EnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// EnvInt reads an integer such as a size in bytes from the environment
+// variable key, def is returned when it is unset or invalid.
+func EnvInt(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Errorf("invalid %s=%q, using %d, err=%s", key, v, def, err)
+		return def
+	}
+	return n
+}
+
+// EnvBool reads a strconv.ParseBool value such as "true" from the environment
+// variable key, def is returned when it is unset or invalid.
+func EnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Errorf("invalid %s=%q, using %t, err=%s", key, v, def, err)
+		return def
+	}
+	return b
+}
+
+// EnvSignalPolicy applies the overrides of the environment variable key,
+// e.g. "HUP=ignore,QUIT=dump-state", to DefaultSignalPolicy. Invalid
+// overrides are logged and the default policy is returned.
+func EnvSignalPolicy(key string) SignalPolicy {
+	p, err := ParseSignalPolicy(DefaultSignalPolicy(), os.Getenv(key))
+	if err != nil {
+		log.Errorf("invalid %s, using the default signal policy, err=%s", key, err)
+		return DefaultSignalPolicy()
+	}
+	return p
+}
+
+// EnvDrainCoordinator builds the coordinator of the URI of the environment
+// variable uriKey, see NewDrainCoordinator, with the number of nodes of
+// slotsKey draining at once, one by default. An invalid URI is logged and
+// no coordinator is returned.
+func EnvDrainCoordinator(uriKey, slotsKey string) DrainCoordinator {
+	c, err := NewDrainCoordinator(os.Getenv(uriKey), int(EnvInt(slotsKey, 1)))
+	if err != nil {
+		log.Errorf("invalid %s, draining without coordination, err=%s", uriKey, err)
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,369 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// EventType tells what happened in an Event.
+type EventType string
+
+const (
+	// EventStarted is published once every hook started.
+	EventStarted EventType = "started"
+	// EventDrainQueued is published when the drain waits for a slot of
+	// the DrainCoordinator.
+	EventDrainQueued EventType = "drain_queued"
+	// EventAdmissionStopped is published when the drain begins.
+	EventAdmissionStopped EventType = "admission_stopped"
+	// EventDrainCanceled is published when the lifecycle serves again after CancelDrain.
+	EventDrainCanceled EventType = "drain_canceled"
+	// EventItemBegun and EventItemFinished follow the work of the kinds
+	// passed to WorkTracker.SetEvents.
+	EventItemBegun    EventType = "item_begun"
+	EventItemFinished EventType = "item_finished"
+	// EventDrainCompleted and EventDrainForced end the drain, the work
+	// abandoned by a forced drain is listed.
+	EventDrainCompleted EventType = "drain_completed"
+	EventDrainForced    EventType = "drain_forced"
+)
+
+// Event is published on an EventBus.
+type Event struct {
+	Seq  uint64    `json:"seq"`
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	Node string    `json:"node,omitempty"`
+	Kind string    `json:"kind,omitempty"`
+	ID   string    `json:"id,omitempty"`
+	// Remaining is the work still in flight once the event happened, of
+	// Kind for the item events.
+	Remaining int         `json:"remaining"`
+	Abandoned []Abandoned `json:"abandoned,omitempty"`
+}
+
+// final reports whether e ends the drain.
+func (e Event) final() bool {
+	return e.Type == EventDrainCompleted || e.Type == EventDrainForced
+}
+
+// eventHistory is the number of events kept for the late subscribers.
+const eventHistory = 256
+
+// EventBus hands the events to its subscribers without ever blocking the
+// publisher, a subscriber falling behind loses the events its buffer can't
+// hold. A nil *EventBus drops the events.
+type EventBus struct {
+	clock clock.Clock
+	node  string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []Event
+	subs    map[*Subscription]struct{}
+}
+
+// NewEventBus stamps the events with the time of clk, nil is the wall
+// clock, and with the host name.
+func NewEventBus(clk clock.Clock) *EventBus {
+	node, _ := os.Hostname()
+	return &EventBus{
+		clock: clock.Or(clk),
+		node:  node,
+		subs:  map[*Subscription]struct{}{},
+	}
+}
+
+// Publish numbers e, stamps it and hands it to the subscribers.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	e.Time = b.clock.Now()
+	e.Node = b.node
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistory {
+		b.history = b.history[len(b.history)-eventHistory:]
+	}
+	for sub := range b.subs {
+		select {
+		case sub.c <- e:
+		default:
+			sub.dropped++
+			if sub.dropped == 1 {
+				log.Errorf("events: subscriber %s falls behind, dropping events", sub.name)
+			}
+		}
+	}
+}
+
+// History returns the events kept after seq, the oldest first.
+func (b *EventBus) History(seq uint64) []Event {
+	events := []Event{}
+	if b == nil {
+		return events
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.history {
+		if e.Seq > seq {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (b *EventBus) latest() (Event, bool) {
+	if b == nil {
+		return Event{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.history) == 0 {
+		return Event{}, false
+	}
+	return b.history[len(b.history)-1], true
+}
+
+// Subscription receives the events published after Subscribe on C.
+type Subscription struct {
+	C <-chan Event
+
+	name    string
+	bus     *EventBus
+	c       chan Event
+	dropped int
+}
+
+// Subscribe buffers up to buffer events for the subscriber name, C is
+// closed right away on a nil bus.
+func (b *EventBus) Subscribe(name string, buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, name: name, bus: b, c: c}
+	if b == nil {
+		close(c)
+		return sub
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Close stops the subscription and closes C, the events buffered so far
+// can still be read.
+func (s *Subscription) Close() {
+	if s.bus == nil {
+		return
+	}
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// SetEvents publishes the begin and the end of the items of kinds on b.
+func (t *WorkTracker) SetEvents(b *EventBus, kinds ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = b
+	t.eventKinds = kinds
+}
+
+// publishLocked must be called with t.mu held.
+func (t *WorkTracker) publishLocked(typ EventType, key workKey) {
+	if t.events == nil || !matchKind(key.kind, t.eventKinds) {
+		return
+	}
+	remaining := 0
+	for k := range t.items {
+		if k.kind == key.kind {
+			remaining++
+		}
+	}
+	t.events.Publish(Event{Type: typ, Kind: key.kind, ID: key.id, Remaining: remaining})
+}
+
+// publishTransition publishes the events of the transition from to.
+func (l *Lifecycle) publishTransition(from, to State) {
+	var typ EventType
+	switch {
+	case to == StateServing && (from == StateDraining || from == StateQueued):
+		typ = EventDrainCanceled
+	case to == StateServing:
+		typ = EventStarted
+	case to == StateQueued:
+		typ = EventDrainQueued
+	case to == StateDraining:
+		typ = EventAdmissionStopped
+	default:
+		return
+	}
+	l.Events.Publish(Event{Type: typ, Remaining: l.inFlight()})
+}
+
+// publishDrained publishes the end of the drain, drainErr is set when it was cut off.
+func (l *Lifecycle) publishDrained(drainErr *DrainError) {
+	if drainErr != nil {
+		l.Events.Publish(Event{Type: EventDrainForced, Remaining: l.inFlight(), Abandoned: drainErr.Abandoned})
+		return
+	}
+	l.Events.Publish(Event{Type: EventDrainCompleted, Remaining: l.inFlight()})
+}
+
+// inFlight counts the work in flight reported by the hooks.
+func (l *Lifecycle) inFlight() int {
+	l.mu.Lock()
+	hooks := l.hooks
+	l.mu.Unlock()
+	n := 0
+	for _, h := range hooks {
+		if h.InFlight != nil {
+			n += len(h.InFlight())
+		}
+	}
+	return n
+}
+
+// LogEvents writes the events of b to the structured log until the returned
+// func is called, which returns once the events published so far are logged.
+func LogEvents(b *EventBus) func() {
+	sub := b.Subscribe("log", 256)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range sub.C {
+			fields := []zap.Field{
+				zap.Uint64("seq", e.Seq),
+				zap.String("type", string(e.Type)),
+				zap.Int("remaining", e.Remaining),
+			}
+			if e.Kind != "" {
+				fields = append(fields, zap.String("kind", e.Kind), zap.String("id", e.ID))
+			}
+			for _, a := range e.Abandoned {
+				fields = append(fields, zap.Strings("abandoned."+a.Hook, a.IDs))
+			}
+			log.Info("lifecycle event", fields...)
+		}
+	}()
+	return func() {
+		sub.Close()
+		<-done
+	}
+}
+
+// EventHooks logs the events of b while the hooks run and flushes the
+// webhooks w, which may be nil, once the drain is over. Append them after
+// the telemetry hooks so that the events are flushed before the logger.
+func EventHooks(b *EventBus, w *Webhooks) []Hook {
+	var stopLog func()
+	return []Hook{
+		{
+			Name:  "events",
+			Phase: PhaseFlushTelemetry,
+			OnStart: func(ctx context.Context) error {
+				stopLog = LogEvents(b)
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				var err error
+				if w != nil {
+					err = w.Close(ctx)
+				}
+				stopLog()
+				return err
+			},
+		},
+	}
+}
+
+const EventsPath = "/events"
+
+// eventsKeepAlive is the interval of the comments keeping an idle stream open.
+const eventsKeepAlive = 15 * time.Second
+
+// RegisterEventsHandler streams the events of b as Server-Sent Events on
+// EventsPath behind auth, e.g. AdminAuth. The events name the work in
+// flight, an upload ID is enough to resume the upload, so the stream is not
+// served when auth is nil. The events kept after the Last-Event-ID header
+// are sent first. The stream ends with the drain so that it does not hold
+// the shutdown of the server.
+func RegisterEventsHandler(e *echo.Echo, b *EventBus, auth echo.MiddlewareFunc) {
+	if auth == nil {
+		return
+	}
+	e.GET(EventsPath, func(c echo.Context) error {
+		sub := b.Subscribe("sse "+c.RealIP(), 64)
+		defer sub.Close()
+		last, _ := strconv.ParseUint(c.Request().Header.Get("Last-Event-ID"), 10, 64)
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(http.StatusOK)
+		res.Flush()
+
+		send := func(ev Event) error {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			last = ev.Seq
+			if _, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data); err != nil {
+				return err
+			}
+			res.Flush()
+			return nil
+		}
+		for _, ev := range b.History(last) {
+			if err := send(ev); err != nil {
+				return nil
+			}
+		}
+		if ev, ok := b.latest(); ok && ev.final() {
+			return nil
+		}
+
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case ev, ok := <-sub.C:
+				if !ok {
+					return nil
+				}
+				if ev.Seq <= last {
+					continue
+				}
+				if err := send(ev); err != nil || ev.final() {
+					return nil
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+				res.Flush()
+			case <-c.Request().Context().Done():
+				return nil
+			}
+		}
+	}, auth)
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus(nil)
+	tracker := NewWorkTracker()
+	tracker.SetEvents(b, KindUpload)
+	sub := b.Subscribe("test", 1)
+
+	done := tracker.Begin(KindUpload, "a")
+	// The requests are not published, the second upload overflows the buffer.
+	tracker.Begin(KindRequest, "r")
+	tracker.Begin(KindUpload, "b")
+	done()
+	sub.Close()
+
+	var got []Event
+	for e := range sub.C {
+		got = append(got, e)
+	}
+	if len(got) != 1 || got[0].Type != EventItemBegun || got[0].ID != "a" || got[0].Remaining != 1 || got[0].Seq != 1 {
+		t.Errorf("subscription got %+v, want item_begun of a", got)
+	}
+
+	var history []string
+	for _, e := range b.History(1) {
+		history = append(history, string(e.Type)+" "+e.ID)
+	}
+	if want := []string{"item_begun b", "item_finished a"}; !reflect.DeepEqual(history, want) {
+		t.Errorf("History(1) = %v, want %v", history, want)
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	b := NewEventBus(nil)
+	lc := NewLifecycle()
+	lc.Events = b
+	lc.Append(Hook{Name: "uploads", Phase: PhaseDrain, InFlight: func() []string { return []string{"a"} }})
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []EventType
+	for _, e := range b.History(0) {
+		types = append(types, e.Type)
+		if e.Remaining != 1 {
+			t.Errorf("%s reports %d in flight, want 1", e.Type, e.Remaining)
+		}
+	}
+	if want := []EventType{EventStarted, EventAdmissionStopped, EventDrainCompleted}; !reflect.DeepEqual(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		received []Event
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(SignWebhook("secret", body))) {
+			t.Errorf("bad signature %q", r.Header.Get(WebhookSignatureHeader))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// The first delivery fails and is retried.
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get(WebhookEventHeader) != string(e.Type) {
+			t.Errorf("%s = %q, want %q", WebhookEventHeader, r.Header.Get(WebhookEventHeader), e.Type)
+		}
+		received = append(received, e)
+	}))
+	defer srv.Close()
+
+	b := NewEventBus(nil)
+	w := NewWebhooks(b, WebhookConfig{URLs: []string{srv.URL}, Secret: "secret", Backoff: time.Millisecond})
+	b.Publish(Event{Type: EventAdmissionStopped, Remaining: 2})
+	b.Publish(Event{Type: EventDrainCompleted})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 || len(received) != 2 || received[0].Type != EventAdmissionStopped || received[1].Type != EventDrainCompleted {
+		t.Errorf("%d attempts received %+v, want both events in order after a retry", attempts, received)
+	}
+}
+
+func TestWebhooksFlushTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	b := NewEventBus(nil)
+	w := NewWebhooks(b, WebhookConfig{URLs: []string{srv.URL}, Backoff: time.Second, FlushTimeout: 50 * time.Millisecond})
+	for i := 0; i < 3; i++ {
+		b.Publish(Event{Type: EventItemFinished})
+	}
+	// The caller's context has no deadline, the retries would last 15s per event.
+	start := time.Now()
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatalf("Close() = %v, want the events dropped silently", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close() took %s, want the flush timeout", elapsed)
+	}
+}
@@ -1,11 +1,16 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 	"sync"
+	"time"
 
+	"github.com/davidtrse/graceful/log"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/davidtrse/graceful/pkg/drainctx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -16,57 +21,232 @@ const (
 
 type GracefulTUSManager interface {
 	StartNewUpload(string)
+	TouchUpload(string)
+	SetUploadProgress(id string, offset, size int64)
 	DoneUpload(string)
+	AwaitFinalUpload(string)
+	StartFinalUpload(id string, parts []string)
+	LockUpload(string)
+	UnlockUpload(string)
+	HeldLocks() []string
 	CanShutdown() bool
+	Wait(ctx context.Context) error
+	RunningUploads() []string
+	DrainStartedAt() time.Time
+	RejectionConfig() RejectionConfig
 	StartReceivingRequest()
 	StopReceivingRequest()
 	IsReceivingRequest() bool
+	AdmitUpload(remoteAddr, requestURI string, size int64) *Rejection
+	AdmitFinalUpload(remoteAddr, requestURI string, parts []string) *Rejection
+	Pressure() Pressure
+	Metrics() *Metrics
+	EnterMaintenance() error
+	ExitMaintenance() error
+	MaintenanceSince() time.Time
 	EchoMiddleware() echo.MiddlewareFunc
+	Draining() context.Context
+	HardDeadline() context.Context
+	Abort()
 }
 
 type GracefulManager struct {
-	running       map[string]bool
+	// tracker records the running uploads as KindUpload work.
+	tracker       *WorkTracker
+	staleAfter    time.Duration
 	acceptRequest bool
-	mu            sync.Mutex
+	// policy decides which requests are still admitted during the drain.
+	policy AdmissionPolicy
+	// drainTimeout bounds the drain, it is the deadline of RejectAfterDeadline.
+	drainTimeout time.Duration
+	// rejection holds the hints sent to the rejected clients.
+	rejection RejectionConfig
+	// pressure sets when the new uploads are shed, metrics counts them.
+	pressure PressureConfig
+	metrics  *Metrics
+	// drainStartedAt is set by StopReceivingRequest, zero while receiving.
+	drainStartedAt time.Time
+	// maintenanceSince is set by EnterMaintenance, zero out of maintenance.
+	maintenanceSince time.Time
+	// parts are the partial uploads of the final uploads being concatenated.
+	parts map[string][]string
+	// ctxs are handed to the handlers, see Draining and HardDeadline.
+	ctxs  *drainctx.Contexts
+	clock clock.Clock
+	mu    sync.Mutex
 }
 
-func NewShutdownManage() GracefulTUSManager {
-	return &GracefulManager{
+// ErrDraining is returned when the maintenance mode is changed during a drain.
+var ErrDraining = errors.New("draining")
+
+type ManagerOption func(*GracefulManager)
+
+// WithPressure sheds the new uploads past the thresholds of cfg.
+func WithPressure(cfg PressureConfig) ManagerOption {
+	return func(s *GracefulManager) {
+		s.pressure = cfg
+	}
+}
+
+// WithMetrics counts the rejections in m, by default the manager has its own.
+func WithMetrics(m *Metrics) ManagerOption {
+	return func(s *GracefulManager) {
+		s.metrics = m
+	}
+}
+
+// WithTracker shares t with the other components, by default the manager has its own tracker.
+func WithTracker(t *WorkTracker) ManagerOption {
+	return func(s *GracefulManager) {
+		s.tracker = t
+	}
+}
+
+// WithClock measures the drain on c instead of the wall clock, the tracker
+// created by the manager uses it too.
+func WithClock(c clock.Clock) ManagerOption {
+	return func(s *GracefulManager) {
+		s.clock = c
+	}
+}
+
+// WithStaleAfter lets uploads without PATCH activity for longer than d stop
+// blocking the shutdown.
+func WithStaleAfter(d time.Duration) ManagerOption {
+	return func(s *GracefulManager) {
+		s.staleAfter = d
+	}
+}
+
+// WithAdmissionPolicy replaces DefaultAdmissionPolicy.
+func WithAdmissionPolicy(p AdmissionPolicy) ManagerOption {
+	return func(s *GracefulManager) {
+		s.policy = p
+	}
+}
+
+// WithDrainTimeout sets the drain deadline used by RejectAfterDeadline.
+func WithDrainTimeout(d time.Duration) ManagerOption {
+	return func(s *GracefulManager) {
+		s.drainTimeout = d
+	}
+}
+
+// WithRejection sets the Retry-After and peer hints of the rejected requests.
+func WithRejection(cfg RejectionConfig) ManagerOption {
+	return func(s *GracefulManager) {
+		s.rejection = cfg
+	}
+}
+
+func NewShutdownManage(opts ...ManagerOption) GracefulTUSManager {
+	s := &GracefulManager{
 		mu:      sync.Mutex{},
-		running: map[string]bool{},
+		tracker: NewWorkTracker(),
+		policy:  DefaultAdmissionPolicy(),
+		clock:   clock.Real,
+		metrics: NewMetrics(),
+		parts:   map[string][]string{},
 	}
+	ownTracker := s.tracker
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.clock = clock.Or(s.clock)
+	s.ctxs = drainctx.New(s.clock)
+	if s.tracker == ownTracker {
+		s.tracker.SetClock(s.clock)
+	}
+	if s.staleAfter > 0 {
+		s.tracker.SetStaleAfter(KindUpload, s.staleAfter)
+		s.tracker.SetStaleAfter(KindUploadLock, s.staleAfter)
+	}
+	return s
 }
 
 func (s *GracefulManager) StartNewUpload(id string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
 	fmt.Println("Add id to map")
-	s.running[id] = true
+	s.tracker.Begin(KindUpload, id)
 }
 
+// TouchUpload records PATCH activity for a running upload.
+func (s *GracefulManager) TouchUpload(id string) {
+	s.tracker.Touch(KindUpload, id)
+	s.tracker.Touch(KindUploadLock, id)
+}
+
+// SetUploadProgress records the offset reached by a running upload of size bytes.
+func (s *GracefulManager) SetUploadProgress(id string, offset, size int64) {
+	s.tracker.SetProgress(KindUpload, id, offset, size)
+	s.tracker.Touch(KindUploadLock, id)
+}
+
+// DoneUpload ends the upload id and, for a final upload, its partial uploads.
 func (s *GracefulManager) DoneUpload(id string) {
+	s.tracker.End(KindUpload, id)
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.running, id)
+	parts := s.parts[id]
+	delete(s.parts, id)
+	s.mu.Unlock()
+	for _, part := range parts {
+		s.tracker.End(KindUpload, part)
+	}
+}
+
+// LockUpload records the lock a tus request took on an upload, the drain
+// waits for UnlockUpload as for the uploads.
+func (s *GracefulManager) LockUpload(id string) {
+	s.tracker.Begin(KindUploadLock, id)
+}
+
+func (s *GracefulManager) UnlockUpload(id string) {
+	s.tracker.End(KindUploadLock, id)
+}
+
+// HeldLocks returns the sorted IDs of the locked uploads.
+func (s *GracefulManager) HeldLocks() []string {
+	return s.tracker.IDs(KindUploadLock)
 }
 
 func (s *GracefulManager) CanShutdown() bool {
+	return s.tracker.Idle(KindUpload, KindUploadLock)
+}
+
+// RunningUploads returns the sorted IDs of the uploads which are not done yet.
+func (s *GracefulManager) RunningUploads() []string {
+	return s.tracker.IDs(KindUpload)
+}
+
+// DrainStartedAt returns when StopReceivingRequest was called, zero while receiving.
+func (s *GracefulManager) DrainStartedAt() time.Time {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	fmt.Println("CanShutdown, len(s.running)=", s.running)
-	return len(s.running) == 0
+	return s.drainStartedAt
+}
+
+// Wait blocks until every upload is done or stale and its lock released, or
+// ctx is done.
+func (s *GracefulManager) Wait(ctx context.Context) error {
+	return s.tracker.Wait(ctx, KindUpload, KindUploadLock)
 }
 
 func (s *GracefulManager) StartReceivingRequest() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.acceptRequest = true
+	// A canceled drain goes back to the maintenance it started in.
+	s.acceptRequest = s.maintenanceSince.IsZero()
+	s.drainStartedAt = time.Time{}
+	s.ctxs.Reset()
 }
 
 func (s *GracefulManager) StopReceivingRequest() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.drainStartedAt.IsZero() {
+		s.drainStartedAt = s.clock.Now()
+	}
 	s.acceptRequest = false
+	s.ctxs.StartDrain(s.drainTimeout)
 }
 
 func (s *GracefulManager) IsReceivingRequest() bool {
@@ -75,31 +255,126 @@ func (s *GracefulManager) IsReceivingRequest() bool {
 	return s.acceptRequest
 }
 
-func (s *GracefulManager) CanReceiveRequest(isCallTUS bool) bool {
+// AdmitUpload decides on a new upload of size bytes, -1 when its length is
+// deferred. It returns the rejection to answer with, nil admits the upload.
+func (s *GracefulManager) AdmitUpload(remoteAddr, requestURI string, size int64) *Rejection {
+	cfg := s.RejectionConfig()
+	rej := cfg.NewRejection(remoteAddr, requestURI)
+	if !s.IsReceivingRequest() {
+		s.metrics.Rejected(ReasonDraining)
+		return &rej
+	}
+
+	reason, status, detail := s.pressure.Shed(s.Pressure(), size)
+	if reason == "" {
+		return nil
+	}
+	rej.Error = "overloaded"
+	if status == http.StatusInsufficientStorage {
+		rej.Error = "insufficient_storage"
+	}
+	rej.Reason = reason
+	rej.Message = fmt.Sprintf("server is overloaded (%s), retry later or on the peer", detail)
+	rej.Status = status
+	s.metrics.Rejected(reason)
+	return &rej
+}
+
+// Pressure reads the resources the new uploads are shed on. The drain window
+// of an upload admitted now is the whole drain timeout.
+func (s *GracefulManager) Pressure() Pressure {
+	p := ReadPressure(s.pressure, len(s.RunningUploads()))
+	p.Throughput = s.tracker.Rate(KindUpload)
+	p.DrainWindow = s.drainTimeout
+	return p
+}
+
+// Metrics returns the rejections counted by the manager.
+func (s *GracefulManager) Metrics() *Metrics {
+	return s.metrics
+}
+
+// EnterMaintenance stops admitting new uploads without draining: the running
+// uploads, the downloads and the probes are served as during a drain but
+// without deadline, and the handlers are not told to hurry.
+func (s *GracefulManager) EnterMaintenance() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	switch {
+	case !s.drainStartedAt.IsZero():
+		return ErrDraining
+	case !s.maintenanceSince.IsZero():
+		return nil
+	}
+	s.acceptRequest = false
+	s.maintenanceSince = s.clock.Now()
+	return nil
+}
 
-	if !s.acceptRequest && !isCallTUS {
-		return false
+// ExitMaintenance admits the new uploads again.
+func (s *GracefulManager) ExitMaintenance() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.drainStartedAt.IsZero():
+		return ErrDraining
+	case s.maintenanceSince.IsZero():
+		return nil
 	}
+	s.acceptRequest = true
+	s.maintenanceSince = time.Time{}
+	return nil
+}
+
+// MaintenanceSince returns when EnterMaintenance was called, zero out of maintenance.
+func (s *GracefulManager) MaintenanceSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maintenanceSince
+}
 
-	return true
+// Draining is done as soon as StopReceivingRequest is called.
+func (s *GracefulManager) Draining() context.Context {
+	return s.ctxs.Draining()
 }
 
+// HardDeadline is done when the drain is cut off, by the drain timeout or by Abort.
+func (s *GracefulManager) HardDeadline() context.Context {
+	return s.ctxs.HardDeadline()
+}
+
+// Abort cancels HardDeadline, the handlers still running must stop right away.
+func (s *GracefulManager) Abort() {
+	s.ctxs.Abort()
+}
+
+// EchoMiddleware applies the admission policy and hands the admitted requests
+// the draining and hard deadline contexts, see Draining and HardDeadline.
 func (s *GracefulManager) EchoMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			fmt.Println("==========>path:", c.Path())
-			isCallTUS := strings.Contains(c.Path(), "files")
-
-			id := c.Param("fileID")
-			fmt.Println("==========>fileID:", id)
-			fmt.Println("==========>s.CanReceiveRequest(id, isCallTUS):", s.CanReceiveRequest(isCallTUS))
-			if s.CanReceiveRequest(isCallTUS) {
+			method := c.Request().Method
+			id := c.Param(tusParam)
+			if id != "" && method == http.MethodPatch {
+				s.TouchUpload(id)
+			}
+			if s.CanReceiveRequest(method, c.Path(), id) || s.admitsFinalUpload(c) {
+				s.addRejectionHeaders(c)
+				c.SetRequest(c.Request().WithContext(drainctx.With(c.Request().Context(), s.ctxs)))
 				return next(c)
-			} else {
-				return c.NoContent(http.StatusServiceUnavailable)
 			}
+			log.Debugf("rejected %s %s, fileID=%s", method, c.Path(), id)
+			return s.reject(c)
 		}
 	}
 }
+
+// Draining returns the context of c which is done as soon as the drain starts.
+func Draining(c echo.Context) context.Context {
+	return drainctx.Draining(c.Request().Context())
+}
+
+// HardDeadline returns the context of c which is done when the drain is cut off.
+func HardDeadline(c echo.Context) context.Context {
+	return drainctx.HardDeadline(c.Request().Context())
+}
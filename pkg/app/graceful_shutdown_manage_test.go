@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestWaitIgnoresStaleUploads(t *testing.T) {
+	m := NewShutdownManage(WithStaleAfter(50 * time.Millisecond))
+	m.StartNewUpload("abandoned")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := m.Wait(ctx); err != nil {
+		t.Fatalf("Wait = %v, want the stale upload to be ignored", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Wait returned after %s, before the upload turned stale", elapsed)
+	}
+}
+
+func TestTouchKeepsUploadBlocking(t *testing.T) {
+	m := NewShutdownManage(WithStaleAfter(50 * time.Millisecond))
+	m.StartNewUpload("active")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.TouchUpload("active")
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	m.DoneUpload("active")
+	if !m.CanShutdown() {
+		t.Error("CanShutdown = false after the upload is done")
+	}
+}
+
+func TestWaitForLockRelease(t *testing.T) {
+	m := NewShutdownManage()
+	m.StartNewUpload("upload-1")
+	m.LockUpload("upload-1")
+	// The upload completes while the PATCH still holds the lock.
+	m.DoneUpload("upload-1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait with the lock held = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if locks := m.HeldLocks(); len(locks) != 1 || locks[0] != "upload-1" {
+		t.Errorf("HeldLocks = %v, want [upload-1]", locks)
+	}
+	if in := TUSHooks(m)[1].InFlight(); len(in) != 1 || in[0] != "upload-1" {
+		t.Errorf("InFlight = %v, want [upload-1]", in)
+	}
+
+	m.UnlockUpload("upload-1")
+	if !m.CanShutdown() {
+		t.Error("CanShutdown = false after the lock is released")
+	}
+}
+
+func TestEchoMiddlewareDrainContexts(t *testing.T) {
+	m := NewShutdownManage()
+	hooks := TUSHooks(m)
+	hooks[0].OnStart(context.Background())
+	e := echo.New()
+	e.Use(m.EchoMiddleware())
+
+	handled := make(chan echo.Context)
+	release := make(chan struct{})
+	e.GET("/slow", func(c echo.Context) error {
+		handled <- c
+		<-release
+		return nil
+	})
+	go e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	c := <-handled
+	defer close(release)
+
+	if Draining(c).Err() != nil || HardDeadline(c).Err() != nil {
+		t.Fatal("contexts done while receiving")
+	}
+	hooks[0].OnStop(context.Background())
+	if Draining(c).Err() == nil {
+		t.Error("Draining not done once the admission stopped")
+	}
+	if HardDeadline(c).Err() != nil {
+		t.Error("HardDeadline done before the drain was cut off")
+	}
+
+	// The drain is cut off before the uploads are waited for.
+	m.StartNewUpload("upload-1")
+	drainCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hooks[1].OnStop(drainCtx)
+	if HardDeadline(c).Err() == nil {
+		t.Error("HardDeadline not done once the drain was cut off")
+	}
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	DrainzPath  = "/drainz"
+)
+
+// IsProbePath reports whether path is one of the probes.
+func IsProbePath(path string) bool {
+	return path == HealthzPath || path == ReadyzPath || path == DrainzPath
+}
+
+// WorkStatus is an in-flight item as reported by /drainz.
+type WorkStatus struct {
+	WorkItem
+	AgeSeconds float64 `json:"age_seconds"`
+	// Late is set when the ETA falls after the drain deadline.
+	Late bool `json:"late,omitempty"`
+}
+
+// DrainStatus is the body of /drainz.
+type DrainStatus struct {
+	Draining            bool         `json:"draining"`
+	DrainStartedAt      *time.Time   `json:"drain_started_at,omitempty"`
+	DrainElapsedSeconds float64      `json:"drain_elapsed_seconds"`
+	DrainDeadline       *time.Time   `json:"drain_deadline,omitempty"`
+	Uploads             []WorkStatus `json:"uploads"`
+	Transcodes          []WorkStatus `json:"transcodes"`
+	Requests            []WorkStatus `json:"requests"`
+}
+
+// RegisterHealthHandlers serves the liveness, readiness and drain status of appCtx on e.
+// Readiness flips to 503 as soon as the TUS manager stops receiving requests,
+// in maintenance too: the load balancer must not send it the new uploads.
+func RegisterHealthHandlers(e *echo.Echo, appCtx *Context) {
+	e.GET(HealthzPath, func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	e.GET(ReadyzPath, func(c echo.Context) error {
+		if m := appCtx.GracefulTUSManager; m != nil && !m.IsReceivingRequest() {
+			if m.DrainStartedAt().IsZero() && !m.MaintenanceSince().IsZero() {
+				return c.String(http.StatusServiceUnavailable, "maintenance")
+			}
+			return c.String(http.StatusServiceUnavailable, "draining")
+		}
+		return c.String(http.StatusOK, "ready")
+	})
+
+	e.GET(DrainzPath, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, drainStatus(appCtx, appCtx.now()))
+	})
+}
+
+// now reads the clock of the tracker of appCtx.
+func (appCtx *Context) now() time.Time {
+	if appCtx.Tracker != nil {
+		return appCtx.Tracker.Now()
+	}
+	return time.Now()
+}
+
+func drainStatus(appCtx *Context, now time.Time) DrainStatus {
+	status := DrainStatus{
+		Uploads:    []WorkStatus{},
+		Transcodes: []WorkStatus{},
+		Requests:   []WorkStatus{},
+	}
+	if m := appCtx.GracefulTUSManager; m != nil {
+		if startedAt := m.DrainStartedAt(); !startedAt.IsZero() {
+			status.Draining = true
+			status.DrainStartedAt = &startedAt
+			status.DrainElapsedSeconds = now.Sub(startedAt).Seconds()
+		}
+		if deadline, ok := m.HardDeadline().Deadline(); ok {
+			status.DrainDeadline = &deadline
+		}
+	}
+	if appCtx.Tracker != nil {
+		for _, item := range appCtx.Tracker.Snapshot() {
+			ws := WorkStatus{WorkItem: item, AgeSeconds: now.Sub(item.StartedAt).Seconds()}
+			ws.Late = item.ETA != nil && status.DrainDeadline != nil && item.ETA.After(*status.DrainDeadline)
+			switch item.Kind {
+			case KindUpload:
+				status.Uploads = append(status.Uploads, ws)
+			case KindTranscode:
+				status.Transcodes = append(status.Transcodes, ws)
+			case KindRequest:
+				status.Requests = append(status.Requests, ws)
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	tracker := NewWorkTracker()
+	m := NewShutdownManage(WithTracker(tracker))
+	e := echo.New()
+	e.Use(m.EchoMiddleware())
+	RegisterHealthHandlers(e, &Context{GracefulTUSManager: m, Tracker: tracker})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	m.StartReceivingRequest()
+	m.StartNewUpload("upload-1")
+	if rec := get(ReadyzPath); rec.Code != http.StatusOK {
+		t.Errorf("readyz while receiving = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	m.StopReceivingRequest()
+	if rec := get(ReadyzPath); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec := get(HealthzPath); rec.Code != http.StatusOK {
+		t.Errorf("healthz while draining = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec := get(DrainzPath)
+	var status DrainStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Draining || status.DrainStartedAt == nil {
+		t.Errorf("drainz = %+v, want draining", status)
+	}
+	if len(status.Uploads) != 1 || status.Uploads[0].ID != "upload-1" {
+		t.Errorf("drainz uploads = %+v, want upload-1", status.Uploads)
+	}
+}
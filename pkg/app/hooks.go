@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/davidtrse/graceful/kafkas"
+	"github.com/davidtrse/graceful/log"
+	"github.com/labstack/echo/v4"
+)
+
+// EchoHooks serves e on addr, on the listener handed over by the previous
+// process when u is not nil. The listener is bound synchronously so that a
+// busy port fails the startup. After an upgrade the listener is closed as
+// soon as the admission stops, the server is shut down once the work is
+// drained or closed right away when the drain was cut off.
+func EchoHooks(e *echo.Echo, addr string, u *Upgrader) []Hook {
+	if u == nil {
+		u = &Upgrader{}
+	}
+	return []Hook{
+		{
+			Name:  "http",
+			Phase: PhaseCloseConsumers,
+			OnStart: func(ctx context.Context) error {
+				ln, err := u.Listen(addr)
+				if err != nil {
+					return err
+				}
+				e.Listener = ln
+				go func() {
+					err := e.Start(addr)
+					if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+						log.Errorf("shutting down the server..., err=%s", err)
+					}
+				}()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				if IsForced(ctx) {
+					return e.Close()
+				}
+				return e.Shutdown(ctx)
+			},
+		},
+		{
+			Name:      "http.listener",
+			Phase:     PhaseStopAdmission,
+			DependsOn: []string{"http"},
+			OnStop: func(ctx context.Context) error {
+				if !IsUpgrading(ctx) {
+					return nil
+				}
+				return u.CloseListener()
+			},
+		},
+	}
+}
+
+// abortOnCutOff calls abort when the drain was cut off, while waiting or
+// before, the work still running sees its hard deadline context done. Work
+// which stopped on the hard deadline of its manager was cut off too, the
+// drain timeout expiring along with it is awaited. A canceled drain lets
+// the work go on.
+func abortOnCutOff(ctx, hard context.Context, err error, abort func()) error {
+	if IsDrainCanceled(ctx) {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); ok && err == nil && errors.Is(hard.Err(), context.DeadlineExceeded) {
+		<-ctx.Done()
+		err = ctx.Err()
+	}
+	if err != nil || ctx.Err() != nil {
+		abort()
+	}
+	return err
+}
+
+// TUSHooks opens the admission of m on startup, closes it as the first
+// shutdown step and waits for the running uploads. A canceled drain opens
+// the admission again.
+func TUSHooks(m GracefulTUSManager) []Hook {
+	return []Hook{
+		{
+			Name:  "tus.admission",
+			Phase: PhaseStopAdmission,
+			OnStart: func(ctx context.Context) error {
+				m.StartReceivingRequest()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				m.StopReceivingRequest()
+				return nil
+			},
+			OnResume: func(ctx context.Context) error {
+				m.StartReceivingRequest()
+				return nil
+			},
+		},
+		{
+			Name:      "tus.drain",
+			Phase:     PhaseDrain,
+			DependsOn: []string{"tus.admission"},
+			OnStop: func(ctx context.Context) error {
+				return abortOnCutOff(ctx, m.HardDeadline(), m.Wait(ctx), m.Abort)
+			},
+			InFlight: func() []string {
+				return mergeIDs(m.RunningUploads(), m.HeldLocks())
+			},
+		},
+	}
+}
+
+// mergeIDs returns the sorted IDs of a and b, each once.
+func mergeIDs(a, b []string) []string {
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, id := range append(append([]string{}, a...), b...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RequestHooks waits for the HTTP requests recorded by the tracker middleware.
+func RequestHooks(t *WorkTracker) []Hook {
+	return []Hook{
+		{
+			Name:  "http.drain",
+			Phase: PhaseDrain,
+			OnStop: func(ctx context.Context) error {
+				return t.Wait(ctx, KindRequest)
+			},
+			InFlight: func() []string {
+				return t.IDs(KindRequest)
+			},
+		},
+	}
+}
+
+// KafkaHooks stops km from reading new messages, waits for the running
+// transcodes, then closes the readers and finally the writer. A canceled
+// drain lets km read again.
+func KafkaHooks(km kafkas.IKafkaManager) []Hook {
+	return []Hook{
+		{
+			Name:  "kafka.admission",
+			Phase: PhaseStopAdmission,
+			OnStop: func(ctx context.Context) error {
+				km.Close()
+				return nil
+			},
+			OnResume: func(ctx context.Context) error {
+				km.Resume()
+				return nil
+			},
+		},
+		{
+			Name:      "kafka.drain",
+			Phase:     PhaseDrain,
+			DependsOn: []string{"kafka.admission"},
+			OnStop: func(ctx context.Context) error {
+				return abortOnCutOff(ctx, km.HardDeadline(), km.Wait(ctx), km.Abort)
+			},
+			InFlight: km.RunningTranscodes,
+		},
+		{
+			Name:  "kafka.readers",
+			Phase: PhaseCloseConsumers,
+			OnStop: func(ctx context.Context) error {
+				km.StopReadMessage()
+				return nil
+			},
+		},
+		{
+			Name:  "kafka.writer",
+			Phase: PhaseFlushProducers,
+			OnStop: func(ctx context.Context) error {
+				km.StopWriteMessage()
+				return nil
+			},
+		},
+	}
+}
+
+// TelemetryHooks flushes the tracer provider through shutdownTracer and then the logger.
+func TelemetryHooks(shutdownTracer func(ctx context.Context) error) []Hook {
+	return []Hook{
+		{
+			Name:  "logger",
+			Phase: PhaseFlushTelemetry,
+			OnStop: func(ctx context.Context) error {
+				log.Sync()
+				return nil
+			},
+		},
+		{
+			Name:      "tracer",
+			Phase:     PhaseFlushTelemetry,
+			DependsOn: []string{"logger"},
+			OnStop:    shutdownTracer,
+		},
+	}
+}
+
+// JournalHooks closes j once the telemetry is flushed, the work ended
+// during the shutdown is recorded until then.
+func JournalHooks(j *Journal) []Hook {
+	return []Hook{
+		{
+			Name:  "journal",
+			Phase: PhaseFlushTelemetry,
+			OnStop: func(ctx context.Context) error {
+				return j.Close()
+			},
+		},
+	}
+}
@@ -0,0 +1,394 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	journalBegin = "begin"
+	journalEnd   = "end"
+
+	InterruptedPath = "/journal/interrupted"
+)
+
+// journalPoll is how often a process waits for the journal held by another
+// one, e.g. the process it was upgraded from.
+var journalPoll = time.Second
+
+// journalRecord is one line of the journal file.
+type journalRecord struct {
+	Op   string    `json:"op"`
+	Kind string    `json:"kind"`
+	ID   string    `json:"id"`
+	At   time.Time `json:"at"`
+}
+
+// Journal appends the begin and the end of the tracked items of some kinds
+// to a file, so that a process killed mid-drain leaves behind which work was
+// interrupted. The records are not fsynced, they survive the process but not
+// the machine crashing.
+type Journal struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	kinds []string
+	// clock stamps the resolutions by hand, the tracker passes the times of
+	// the items it begins and ends.
+	clock clock.Clock
+	// lock is flocked by the process owning the journal, the only one
+	// which replays and compacts it.
+	lock *os.File
+	// interrupted holds the items of every kind begun by a previous process
+	// and never ended, they are resolved when they end in this process.
+	interrupted map[workKey]WorkItem
+	// open holds the items begun by this process and not ended yet.
+	open map[workKey]time.Time
+	// recovered is closed once the journal is owned and replayed.
+	recovered   chan struct{}
+	onRecovered []func()
+	closeOnce   sync.Once
+	closed      chan struct{}
+	done        chan struct{}
+}
+
+// OpenJournal opens the journal at path to append the items of kinds, of
+// every kind when none is given. One process owns the journal at a time, it
+// replays the journal, keeping the items begun and never ended as
+// interrupted, and compacts it to those items. A process started by an
+// upgrade appends to the journal its parent still owns and recovers it once
+// the parent closed it, until then it lists no interrupted item.
+func OpenJournal(path string, kinds ...string) (*Journal, error) {
+	j := &Journal{
+		path:        path,
+		kinds:       kinds,
+		clock:       clock.Or(nil),
+		interrupted: map[workKey]WorkItem{},
+		open:        map[workKey]time.Time{},
+		recovered:   make(chan struct{}),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	j.lock = lock
+	owned, err := j.tryLock()
+	if err == nil && owned {
+		close(j.done)
+		err = j.recover()
+	} else if err == nil {
+		log.Infof("journal: %s is held by another process, recovered once it exits", path)
+		j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err == nil {
+			go j.waitOwner()
+		} else {
+			err = fmt.Errorf("journal: %w", err)
+		}
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) tryLock() (bool, error) {
+	err := syscall.Flock(int(j.lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("journal: lock %s: %w", j.lock.Name(), err)
+	}
+	return true, nil
+}
+
+// waitOwner recovers the journal once the process holding it released it.
+func (j *Journal) waitOwner() {
+	defer close(j.done)
+	for {
+		select {
+		case <-j.closed:
+			return
+		case <-time.After(journalPoll):
+		}
+		owned, err := j.tryLock()
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+		if owned {
+			log.Infof("journal: %s released by the other process, recovering it", j.path)
+			if err := j.recover(); err != nil {
+				log.Errorf("%s", err)
+			}
+			return
+		}
+	}
+}
+
+// recover replays and compacts the owned journal, the items open in this
+// process are not interrupted, then appends to the compacted journal.
+func (j *Journal) recover() error {
+	j.mu.Lock()
+	if err := j.replay(); err != nil {
+		j.mu.Unlock()
+		return err
+	}
+	for key := range j.open {
+		delete(j.interrupted, key)
+	}
+	if err := j.compact(); err != nil {
+		j.mu.Unlock()
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		j.mu.Unlock()
+		return fmt.Errorf("journal: %w", err)
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f = f
+	callbacks := j.onRecovered
+	j.onRecovered = nil
+	close(j.recovered)
+	j.mu.Unlock()
+	for _, f := range callbacks {
+		f()
+	}
+	return nil
+}
+
+// OnRecovered calls f once the interrupted items are known, right away when
+// they already are.
+func (j *Journal) OnRecovered(f func()) {
+	j.mu.Lock()
+	select {
+	case <-j.recovered:
+		j.mu.Unlock()
+		f()
+		return
+	default:
+	}
+	j.onRecovered = append(j.onRecovered, f)
+	j.mu.Unlock()
+}
+
+func (j *Journal) replay() error {
+	j.interrupted = map[workKey]WorkItem{}
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// The last line is torn when the process was killed mid-write.
+			log.Errorf("journal: %s:%d skipped, err=%s", j.path, line, err)
+			continue
+		}
+		key := workKey{rec.Kind, rec.ID}
+		switch rec.Op {
+		case journalBegin:
+			j.interrupted[key] = WorkItem{Kind: rec.Kind, ID: rec.ID, StartedAt: rec.At, LastActivity: rec.At}
+		case journalEnd:
+			delete(j.interrupted, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the journal with the interrupted items, of every kind, and
+// the items open in this process.
+func (j *Journal) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	records := []journalRecord{}
+	for _, item := range j.interrupted {
+		records = append(records, journalRecord{Op: journalBegin, Kind: item.Kind, ID: item.ID, At: item.StartedAt})
+	}
+	for key, at := range j.open {
+		records = append(records, journalRecord{Op: journalBegin, Kind: key.kind, ID: key.id, At: at})
+	}
+	sort.Slice(records, func(a, b int) bool {
+		return records[a].At.Before(records[b].At)
+	})
+	w := bufio.NewWriter(tmp)
+	for _, rec := range records {
+		if err := writeRecord(w, rec); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	return nil
+}
+
+func writeRecord(w io.Writer, rec journalRecord) error {
+	line, _ := json.Marshal(rec)
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) begin(kind, id string, at time.Time) {
+	if !matchKind(kind, j.kinds) {
+		return
+	}
+	j.mu.Lock()
+	j.open[workKey{kind, id}] = at
+	j.mu.Unlock()
+	j.append(journalRecord{Op: journalBegin, Kind: kind, ID: id, At: at})
+}
+
+// end records the end of an item at and resolves it when it was interrupted.
+func (j *Journal) end(kind, id string, at time.Time) {
+	if !matchKind(kind, j.kinds) {
+		return
+	}
+	j.mu.Lock()
+	delete(j.interrupted, workKey{kind, id})
+	delete(j.open, workKey{kind, id})
+	j.mu.Unlock()
+	j.append(journalRecord{Op: journalEnd, Kind: kind, ID: id, At: at})
+}
+
+func (j *Journal) append(rec journalRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return
+	}
+	if err := writeRecord(j.f, rec); err != nil {
+		log.Errorf("%s", err)
+	}
+}
+
+// Interrupted returns the items of the given kinds, of every kind of the
+// journal when none is given, which a previous process began and never
+// ended, the oldest first.
+func (j *Journal) Interrupted(kinds ...string) []WorkItem {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.sortedInterrupted(kinds)
+}
+
+func (j *Journal) sortedInterrupted(kinds []string) []WorkItem {
+	items := []WorkItem{}
+	for key, item := range j.interrupted {
+		if matchKind(key.kind, j.kinds) && matchKind(key.kind, kinds) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].StartedAt.Before(items[b].StartedAt)
+	})
+	return items
+}
+
+// SetClock sets the clock stamping the resolutions by hand, nil is the real one.
+func (j *Journal) SetClock(c clock.Clock) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.clock = clock.Or(c)
+}
+
+// Resolve forgets an interrupted item which will never end in this process,
+// e.g. an upload the client gave up on.
+func (j *Journal) Resolve(kind, id string) bool {
+	j.mu.Lock()
+	now := j.clock.Now()
+	j.mu.Unlock()
+	return j.resolve(kind, id, now)
+}
+
+func (j *Journal) resolve(kind, id string, at time.Time) bool {
+	if !matchKind(kind, j.kinds) {
+		return false
+	}
+	j.mu.Lock()
+	_, ok := j.interrupted[workKey{kind, id}]
+	j.mu.Unlock()
+	if ok {
+		j.end(kind, id, at)
+	}
+	return ok
+}
+
+// Close stops appending and releases the journal to the next process.
+func (j *Journal) Close() error {
+	j.closeOnce.Do(func() { close(j.closed) })
+	<-j.done
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.lock != nil {
+		j.lock.Close()
+		j.lock = nil
+	}
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// RegisterJournalHandlers lists the interrupted items of j on
+// GET /journal/interrupted and resolves one on DELETE /journal/interrupted/:kind/:id
+// behind auth, e.g. AdminAuth. The resolution is not served when auth is nil.
+func RegisterJournalHandlers(e *echo.Echo, j *Journal, auth echo.MiddlewareFunc) {
+	e.GET(InterruptedPath, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, j.Interrupted())
+	})
+	if auth == nil {
+		return
+	}
+
+	e.DELETE(InterruptedPath+"/:kind/:id", func(c echo.Context) error {
+		if !j.Resolve(c.Param("kind"), c.Param("id")) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}, auth)
+}
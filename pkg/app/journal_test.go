@@ -0,0 +1,223 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+)
+
+func openTrackerJournal(t *testing.T, path string) (*WorkTracker, *Journal) {
+	t.Helper()
+	j, err := OpenJournal(path, KindUpload, KindTranscode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.Close() })
+	tracker := NewWorkTracker()
+	tracker.SetJournal(j)
+	return tracker, j
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.journal")
+
+	tracker, j := openTrackerJournal(t, path)
+	tracker.Begin(KindUpload, "done")
+	tracker.Begin(KindUpload, "killed")
+	tracker.Begin(KindTranscode, "transcode-1")
+	tracker.Begin(KindRequest, "not-journaled")
+	tracker.End(KindUpload, "done")
+	j.Close()
+
+	// The process was killed mid-write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"end","kind":"upl`)
+	f.Close()
+
+	tracker, j = openTrackerJournal(t, path)
+	got := j.Interrupted()
+	if len(got) != 2 || got[0].ID != "killed" || got[1].ID != "transcode-1" {
+		t.Fatalf("Interrupted() = %+v, want killed and transcode-1", got)
+	}
+	if uploads := j.Interrupted(KindUpload); len(uploads) != 1 {
+		t.Errorf("Interrupted(upload) = %+v, want killed only", uploads)
+	}
+
+	// The upload completes in this process without being begun again,
+	// the transcode is requeued and done.
+	tracker.End(KindUpload, "killed")
+	tracker.Begin(KindTranscode, "transcode-1")()
+	j.Close()
+
+	_, j = openTrackerJournal(t, path)
+	if got := j.Interrupted(); len(got) != 0 {
+		t.Errorf("Interrupted() after the items ended = %+v, want none", got)
+	}
+}
+
+func TestJournalHandlers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.journal")
+	tracker, j := openTrackerJournal(t, path)
+	tracker.Begin(KindUpload, "abandoned")
+	j.Close()
+
+	_, j = openTrackerJournal(t, path)
+	e := echo.New()
+	RegisterJournalHandlers(e, j, AdminAuth("admin"))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, InterruptedPath, nil))
+	if rec.Code != http.StatusOK || !json.Valid(rec.Body.Bytes()) {
+		t.Fatalf("GET %s = %d %s", InterruptedPath, rec.Code, rec.Body)
+	}
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"admin", http.StatusNoContent},
+		{"admin", http.StatusNotFound},
+	} {
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, InterruptedPath+"/upload/abandoned", nil)
+		if tt.token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+		}
+		e.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("DELETE with token %q = %d, want %d", tt.token, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestJournalUpgrade(t *testing.T) {
+	poll := journalPoll
+	journalPoll = 10 * time.Millisecond
+	t.Cleanup(func() { journalPoll = poll })
+	path := filepath.Join(t.TempDir(), "upload.journal")
+
+	tracker, j := openTrackerJournal(t, path)
+	tracker.Begin(KindUpload, "killed")
+	j.Close()
+
+	parent, parentJournal := openTrackerJournal(t, path)
+	parent.Begin(KindUpload, "parent")
+	// The process started by the upgrade appends to the journal the parent
+	// still owns, the uploads of the parent are not interrupted.
+	child, childJournal := openTrackerJournal(t, path)
+	recovered := make(chan struct{})
+	childJournal.OnRecovered(func() { close(recovered) })
+	if got := childJournal.Interrupted(); len(got) != 0 {
+		t.Fatalf("Interrupted() while the parent runs = %+v, want none", got)
+	}
+	child.Begin(KindUpload, "child")
+	parent.End(KindUpload, "parent")
+	parentJournal.Close()
+
+	select {
+	case <-recovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the journal was not recovered once the parent closed it")
+	}
+	if got := childJournal.Interrupted(); len(got) != 1 || got[0].ID != "killed" {
+		t.Fatalf("Interrupted() after the parent exited = %+v, want killed", got)
+	}
+	childJournal.Close()
+
+	// The end of the parent upload was kept, the child one is interrupted.
+	_, j = openTrackerJournal(t, path)
+	if got := j.Interrupted(); len(got) != 2 || got[0].ID != "killed" || got[1].ID != "child" {
+		t.Errorf("Interrupted() after the child exited = %+v, want killed and child", got)
+	}
+}
+
+func TestJournalOtherKinds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.journal")
+	open := func(kind string) *Journal {
+		j, err := OpenJournal(path, kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { j.Close() })
+		return j
+	}
+
+	transcodes := NewWorkTracker()
+	j := open(KindTranscode)
+	transcodes.SetJournal(j)
+	transcodes.Begin(KindTranscode, "transcode-1")
+	j.Close()
+
+	// The upload journal neither lists nor drops the transcodes.
+	j = open(KindUpload)
+	if got := j.Interrupted(); len(got) != 0 {
+		t.Errorf("Interrupted() of the uploads = %+v, want none", got)
+	}
+	if j.Resolve(KindTranscode, "transcode-1") {
+		t.Error("the upload journal resolved a transcode")
+	}
+	j.Close()
+
+	j = open(KindTranscode)
+	if got := j.Interrupted(KindTranscode); len(got) != 1 || got[0].ID != "transcode-1" {
+		t.Errorf("Interrupted(transcode) = %+v, want transcode-1", got)
+	}
+}
+
+func TestJournalClock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.journal")
+	records := func() []journalRecord {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs := []journalRecord{}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec journalRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+	start := time.Unix(0, 0).UTC()
+	clk := &stepClock{Clock: clock.Real, now: start}
+
+	tracker, j := openTrackerJournal(t, path)
+	tracker.SetClock(clk)
+	tracker.Begin(KindUpload, "done")
+	tracker.Begin(KindUpload, "killed")
+	clk.now = start.Add(time.Minute)
+	tracker.End(KindUpload, "done")
+	j.Close()
+	recs := records()
+	if last := recs[len(recs)-1]; last.Op != journalEnd || !last.At.Equal(start.Add(time.Minute)) {
+		t.Errorf("end record = %+v, want at %s", last, start.Add(time.Minute))
+	}
+
+	// A resolution by hand is stamped with the clock of the journal.
+	_, j = openTrackerJournal(t, path)
+	j.SetClock(clk)
+	clk.now = start.Add(2 * time.Minute)
+	if !j.Resolve(KindUpload, "killed") {
+		t.Fatal("Resolve(killed) = false")
+	}
+	j.Close()
+	recs = records()
+	if last := recs[len(recs)-1]; last.ID != "killed" || !last.At.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("resolution record = %+v, want at %s", last, start.Add(2*time.Minute))
+	}
+}
@@ -0,0 +1,536 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/davidtrse/graceful/pkg/clock"
+)
+
+// Phase orders the shutdown of the registered hooks. Phases run in ascending
+// order, a phase only starts once every hook of the previous phase returned.
+type Phase int
+
+const (
+	// PhaseStopAdmission stops accepting new work (HTTP requests, Kafka messages).
+	PhaseStopAdmission Phase = iota
+	// PhaseDrain waits for the in-flight work to finish.
+	PhaseDrain
+	// PhaseCloseConsumers closes whatever takes work in: HTTP servers, Kafka readers.
+	PhaseCloseConsumers
+	// PhaseFlushProducers flushes and closes Kafka writers.
+	PhaseFlushProducers
+	// PhaseFlushTelemetry flushes the tracer provider and the logger.
+	PhaseFlushTelemetry
+)
+
+var phases = []Phase{
+	PhaseStopAdmission,
+	PhaseDrain,
+	PhaseCloseConsumers,
+	PhaseFlushProducers,
+	PhaseFlushTelemetry,
+}
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseStopAdmission:
+		return "stop-admission"
+	case PhaseDrain:
+		return "drain"
+	case PhaseCloseConsumers:
+		return "close-consumers"
+	case PhaseFlushProducers:
+		return "flush-producers"
+	case PhaseFlushTelemetry:
+		return "flush-telemetry"
+	}
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+// Exit codes returned by ExitCode, a forced drain is told apart from a clean one.
+const (
+	ExitClean  = 0
+	ExitError  = 1
+	ExitForced = 3
+)
+
+// ErrForced is the reason of a DrainError when the drain was cut short by Force.
+var ErrForced = errors.New("drain forced")
+
+// Hook is a start/stop pair registered by a component.
+// OnStart hooks run in dependency order, OnStop hooks run phase by phase and,
+// inside a phase, in reverse dependency order.
+type Hook struct {
+	Name      string
+	Phase     Phase
+	DependsOn []string
+	OnStart   func(ctx context.Context) error
+	OnStop    func(ctx context.Context) error
+	// OnResume undoes OnStop when the drain is canceled, it is only called
+	// for the hooks of the stop-admission and the drain phases.
+	OnResume func(ctx context.Context) error
+	// OnReload applies the configuration again, see SignalReload.
+	OnReload func(ctx context.Context) error
+	// InFlight lists the IDs of the work still running, it is reported
+	// when the drain is cut off.
+	InFlight func() []string
+}
+
+// Abandoned is the work of one hook which was still running when the drain was cut off.
+type Abandoned struct {
+	Hook string   `json:"hook"`
+	IDs  []string `json:"ids"`
+}
+
+// DrainError is returned by Stop when the drain phase hit DrainTimeout or was forced.
+type DrainError struct {
+	// Reason is context.DeadlineExceeded or ErrForced.
+	Reason    error
+	Abandoned []Abandoned
+}
+
+func (e *DrainError) Error() string {
+	parts := make([]string, 0, len(e.Abandoned))
+	for _, a := range e.Abandoned {
+		parts = append(parts, fmt.Sprintf("%s=%v", a.Hook, a.IDs))
+	}
+	return fmt.Sprintf("drain cut off (%s), abandoned: %s", e.Reason, strings.Join(parts, ", "))
+}
+
+func (e *DrainError) Unwrap() error {
+	return e.Reason
+}
+
+// ExitCode maps the error returned by Run to a process exit code.
+func ExitCode(err error) int {
+	var drainErr *DrainError
+	switch {
+	case err == nil:
+		return ExitClean
+	case errors.As(err, &drainErr):
+		return ExitForced
+	}
+	return ExitError
+}
+
+type forcedKey struct{}
+
+// IsForced reports whether ctx belongs to the phases following a cut off drain.
+// Hooks use it to close connections instead of waiting for them.
+func IsForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(forcedKey{}).(bool)
+	return forced
+}
+
+// SignalSource delivers the signals to Run, the tests replace OSSignals with a fake.
+type SignalSource interface {
+	Notify(c chan<- os.Signal, sig ...os.Signal)
+	Stop(c chan<- os.Signal)
+}
+
+// OSSignals delivers the signals received by the process.
+type OSSignals struct{}
+
+func (OSSignals) Notify(c chan<- os.Signal, sig ...os.Signal) { signal.Notify(c, sig...) }
+func (OSSignals) Stop(c chan<- os.Signal)                     { signal.Stop(c) }
+
+// Lifecycle drives the startup, the signal waiting and the phased shutdown
+// of the hooks appended to it.
+type Lifecycle struct {
+	// Signals tells Run what to do on each signal, see DefaultSignalPolicy.
+	Signals SignalPolicy
+	// DrainTimeout bounds the drain phase, zero waits forever.
+	DrainTimeout time.Duration
+	// Upgrader, when set, hands the listener over to a new process on
+	// SignalUpgrade before shutting down.
+	Upgrader *Upgrader
+	// ReopenLogs runs on SignalReopenLogs, it defaults to log.Reopen.
+	ReopenLogs func() error
+	// Events, when set, receives the transitions and the end of the drain.
+	Events *EventBus
+	// Coordinator, when set, limits the nodes draining at once, Stop
+	// waits for a slot in StateQueued.
+	Coordinator DrainCoordinator
+	// SignalSource defaults to OSSignals and Clock, which measures
+	// DrainTimeout, to the wall clock.
+	SignalSource SignalSource
+	Clock        clock.Clock
+
+	mu         sync.Mutex
+	hooks      []Hook
+	started    []Hook
+	forced     bool
+	forceDrain context.CancelFunc
+	upgradeReq chan chan error
+
+	state     State
+	since     time.Time
+	observers []func(from, to State)
+	// canceled is set by CancelDrain, resumed is closed once Stop resumed
+	// the hooks and upgrading is set while the drain follows an upgrade.
+	canceled  bool
+	resumed   chan struct{}
+	upgrading bool
+}
+
+// upgradeReadyTimeout bounds the wait for the new process started by an upgrade.
+const upgradeReadyTimeout = time.Minute
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{
+		Signals:      DefaultSignalPolicy(),
+		SignalSource: OSSignals{},
+		Clock:        clock.Real,
+		upgradeReq:   make(chan chan error),
+	}
+}
+
+func (l *Lifecycle) Append(hooks ...Hook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, hooks...)
+}
+
+// Start runs the OnStart hooks. If one of them fails, the hooks started so far
+// are stopped again and the error is returned.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	ordered, err := sortHooks(l.hooks)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	l.setState(StateStarting)
+	for _, h := range ordered {
+		if h.OnStart != nil {
+			log.Infof("lifecycle: starting %s", h.Name)
+			if err := h.OnStart(ctx); err != nil {
+				if stopErr := l.Stop(ctx); stopErr != nil {
+					log.Errorf("lifecycle: rollback failed, err=%s", stopErr)
+				}
+				return fmt.Errorf("start %s: %w", h.Name, err)
+			}
+		}
+		l.mu.Lock()
+		l.started = append(l.started, h)
+		l.mu.Unlock()
+	}
+	l.setState(StateServing)
+	return nil
+}
+
+// Stop runs the OnStop hooks of the started hooks phase by phase. A failing
+// hook does not prevent the others from running. When the drain phase is
+// cut off, the remaining phases run with a forced ctx and a *DrainError
+// listing the abandoned work is returned, otherwise the first error.
+// Until the consumers are closed, CancelDrain makes Stop resume the hooks
+// and return ErrDrainCanceled. With a Coordinator the drain begins once it
+// has a slot.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	started := l.started
+	l.started = nil
+	l.canceled = false
+	l.resumed = make(chan struct{})
+	l.upgrading = IsUpgrading(ctx)
+	l.mu.Unlock()
+	release, ok := l.queue(ctx)
+	if !ok {
+		return l.serveAgain(started)
+	}
+	defer release()
+	l.setState(StateDraining)
+	ctx = context.WithValue(ctx, canceledKey{}, l.isCanceled)
+
+	var firstErr, drainErr error
+	for _, p := range phases {
+		if p == PhaseCloseConsumers && !l.stopping() {
+			return l.resume(ctx, started)
+		}
+		if p != PhaseDrain {
+			if err := stopPhase(ctx, p, started); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		drainCtx, cancel := l.drainContext(ctx)
+		err := stopPhase(drainCtx, p, started)
+		if l.isCanceled() {
+			cancel()
+			continue
+		}
+		var abandoned *DrainError
+		if err != nil && drainCtx.Err() != nil {
+			abandoned = abandon(drainCtx, started)
+			drainErr = abandoned
+			log.Errorf("lifecycle: %s", drainErr)
+			ctx = context.WithValue(ctx, forcedKey{}, true)
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		cancel()
+		l.publishDrained(abandoned)
+	}
+
+	l.setState(StateStopped)
+	if drainErr != nil {
+		return drainErr
+	}
+	return firstErr
+}
+
+// Force cuts the drain phase short, whether it is running or yet to come.
+func (l *Lifecycle) Force() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.forced = true
+	if l.forceDrain != nil {
+		l.forceDrain()
+	}
+}
+
+func (l *Lifecycle) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	drainCtx, cancelTimeout := ctx, context.CancelFunc(func() {})
+	if l.DrainTimeout > 0 {
+		drainCtx, cancelTimeout = clock.WithTimeout(ctx, clock.Or(l.Clock), l.DrainTimeout)
+	}
+	drainCtx, cancel := context.WithCancel(drainCtx)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.forced || l.canceled {
+		cancel()
+	}
+	l.forceDrain = cancel
+	return drainCtx, func() {
+		cancel()
+		cancelTimeout()
+	}
+}
+
+func stopPhase(ctx context.Context, p Phase, started []Hook) error {
+	var firstErr error
+	for i := len(started) - 1; i >= 0; i-- {
+		h := started[i]
+		if h.Phase != p || h.OnStop == nil {
+			continue
+		}
+		log.Infof("lifecycle: %s: stopping %s", p, h.Name)
+		if err := h.OnStop(ctx); err != nil {
+			log.Errorf("lifecycle: %s: stop %s failed, err=%s", p, h.Name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("stop %s: %w", h.Name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func abandon(drainCtx context.Context, started []Hook) *DrainError {
+	err := &DrainError{Reason: ErrForced}
+	if errors.Is(drainCtx.Err(), context.DeadlineExceeded) {
+		err.Reason = context.DeadlineExceeded
+	}
+	for _, h := range started {
+		if h.InFlight == nil {
+			continue
+		}
+		if ids := h.InFlight(); len(ids) > 0 {
+			err.Abandoned = append(err.Abandoned, Abandoned{Hook: h.Name, IDs: ids})
+		}
+	}
+	return err
+}
+
+// Run starts the hooks, waits for a SignalDrain or SignalStop signal or for
+// ctx to be done and then executes the phased shutdown. During the drain
+// another of those signals forces it, SignalResume cancels it and Run waits
+// for the next signal again. With an Upgrader, SignalUpgrade or Upgrade hand
+// the listener over to a new process and the shutdown follows once it is ready.
+// The other actions of Signals run whenever their signal arrives.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	if err := l.Start(ctx); err != nil {
+		return err
+	}
+	if l.Upgrader != nil {
+		if err := l.Upgrader.Ready(); err != nil {
+			log.Errorf("lifecycle: notify the upgrading process, err=%s", err)
+		}
+	}
+
+	// Every signal of the policy is caught, an ignored SIGHUP must not
+	// terminate the process. Use a buffered channel to avoid missing signals as recommended for signal.Notify
+	source := l.SignalSource
+	if source == nil {
+		source = OSSignals{}
+	}
+	sig := make(chan os.Signal, 1)
+	source.Notify(sig, l.Signals.Signals()...)
+	defer source.Stop(sig)
+
+	for {
+		err := l.stopWithSignals(sig, l.waitStop(ctx, sig))
+		if !errors.Is(err, ErrDrainCanceled) {
+			return err
+		}
+		log.Infof("lifecycle: drain canceled, serving again")
+	}
+}
+
+// waitStop waits for a shutdown signal, an upgrade or for ctx to be done and
+// returns the ctx to stop with.
+func (l *Lifecycle) waitStop(ctx context.Context, sig <-chan os.Signal) context.Context {
+	stopCtx := context.Background()
+	for {
+		select {
+		case s := <-sig:
+			switch a := l.Signals.Action(s); a {
+			case SignalDrain:
+				log.Infof("lifecycle: received %s, shutting down", s)
+				return stopCtx
+			case SignalStop:
+				log.Infof("lifecycle: received %s, shutting down without draining", s)
+				l.Force()
+				return stopCtx
+			case SignalUpgrade:
+				if l.Upgrader == nil {
+					log.Infof("lifecycle: received %s, no upgrader", s)
+					continue
+				}
+				log.Infof("lifecycle: received %s, upgrading", s)
+				if err := l.upgradeNow(ctx); err != nil {
+					log.Errorf("lifecycle: upgrade failed, keep serving, err=%s", err)
+					continue
+				}
+				return context.WithValue(stopCtx, upgradingKey{}, true)
+			default:
+				l.handleSignal(ctx, s, a)
+			}
+		case reply := <-l.upgradeReq:
+			err := l.upgradeNow(ctx)
+			reply <- err
+			if err == nil {
+				return context.WithValue(stopCtx, upgradingKey{}, true)
+			}
+		case <-ctx.Done():
+			log.Infof("lifecycle: context done, shutting down")
+			return stopCtx
+		}
+	}
+}
+
+// stopWithSignals runs Stop, meanwhile a second shutdown signal forces the
+// drain and SignalResume cancels it.
+func (l *Lifecycle) stopWithSignals(sig <-chan os.Signal, stopCtx context.Context) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		for {
+			select {
+			case s := <-sig:
+				switch a := l.Signals.Action(s); a {
+				case SignalDrain, SignalStop:
+					log.Infof("lifecycle: received %s again, forcing shutdown", s)
+					l.Force()
+				case SignalResume:
+					if err := l.CancelDrain(); err != nil {
+						log.Errorf("lifecycle: received %s, err=%s", s, err)
+					}
+				case SignalUpgrade:
+				default:
+					l.handleSignal(context.Background(), s, a)
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	return l.Stop(stopCtx)
+}
+
+// Upgrade asks Run to hand the listener over to a new process, it returns
+// once the new process is ready and the shutdown of this one started.
+func (l *Lifecycle) Upgrade(ctx context.Context) error {
+	if l.Upgrader == nil {
+		return errors.New("lifecycle: no upgrader")
+	}
+	reply := make(chan error, 1)
+	select {
+	case l.upgradeReq <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Lifecycle) upgradeNow(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, upgradeReadyTimeout)
+	defer cancel()
+	return l.Upgrader.Upgrade(ctx)
+}
+
+// sortHooks orders the hooks so that every hook comes after its dependencies,
+// otherwise keeping the registration order.
+func sortHooks(hooks []Hook) ([]Hook, error) {
+	byName := make(map[string]int, len(hooks))
+	for i, h := range hooks {
+		if _, ok := byName[h.Name]; ok {
+			return nil, fmt.Errorf("lifecycle: duplicate hook %q", h.Name)
+		}
+		byName[h.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(hooks))
+	ordered := make([]Hook, 0, len(hooks))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("lifecycle: dependency cycle at hook %q", hooks[i].Name)
+		}
+		state[i] = visiting
+		for _, dep := range hooks[i].DependsOn {
+			j, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("lifecycle: hook %q depends on unknown hook %q", hooks[i].Name, dep)
+			}
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		ordered = append(ordered, hooks[i])
+		return nil
+	}
+
+	for i := range hooks {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
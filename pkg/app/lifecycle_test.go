@@ -0,0 +1,217 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func recordHook(calls *[]string, name string, phase Phase, deps ...string) Hook {
+	return Hook{
+		Name:      name,
+		Phase:     phase,
+		DependsOn: deps,
+		OnStart: func(ctx context.Context) error {
+			*calls = append(*calls, "start "+name)
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			*calls = append(*calls, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestLifecycleOrder(t *testing.T) {
+	var calls []string
+	lc := NewLifecycle()
+	lc.Append(
+		recordHook(&calls, "tracer", PhaseFlushTelemetry, "logger"),
+		recordHook(&calls, "logger", PhaseFlushTelemetry),
+		recordHook(&calls, "http", PhaseCloseConsumers, "tracer"),
+		recordHook(&calls, "drain", PhaseDrain, "admission"),
+		recordHook(&calls, "admission", PhaseStopAdmission, "http"),
+	)
+
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"start logger", "start tracer", "start http", "start admission", "start drain",
+		"stop admission", "stop drain", "stop http", "stop tracer", "stop logger",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestLifecycleStartRollback(t *testing.T) {
+	var calls []string
+	lc := NewLifecycle()
+	lc.Append(
+		recordHook(&calls, "first", PhaseCloseConsumers),
+		Hook{
+			Name: "broken",
+			OnStart: func(ctx context.Context) error {
+				return errors.New("boom")
+			},
+		},
+		recordHook(&calls, "never", PhaseCloseConsumers),
+	)
+
+	if err := lc.Start(context.Background()); err == nil {
+		t.Fatal("expected start error")
+	}
+	want := []string{"start first", "stop first"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestLifecycleDependencyCycle(t *testing.T) {
+	lc := NewLifecycle()
+	lc.Append(
+		Hook{Name: "a", DependsOn: []string{"b"}},
+		Hook{Name: "b", DependsOn: []string{"a"}},
+	)
+	if err := lc.Start(context.Background()); err == nil {
+		t.Fatal("expected cycle error")
+	}
+}
+
+func blockingDrain(release <-chan struct{}) Hook {
+	return Hook{
+		Name:  "uploads",
+		Phase: PhaseDrain,
+		OnStop: func(ctx context.Context) error {
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+		InFlight: func() []string {
+			return []string{"upload-1"}
+		},
+	}
+}
+
+func TestLifecycleDrainTimeout(t *testing.T) {
+	var forced bool
+	lc := NewLifecycle()
+	lc.DrainTimeout = 10 * time.Millisecond
+	lc.Append(
+		blockingDrain(make(chan struct{})),
+		Hook{
+			Name:  "http",
+			Phase: PhaseCloseConsumers,
+			OnStop: func(ctx context.Context) error {
+				forced = IsForced(ctx)
+				return nil
+			},
+		},
+	)
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := lc.Stop(context.Background())
+	var drainErr *DrainError
+	if !errors.As(err, &drainErr) {
+		t.Fatalf("err = %v, want *DrainError", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("reason = %v, want deadline exceeded", drainErr.Reason)
+	}
+	want := []Abandoned{{Hook: "uploads", IDs: []string{"upload-1"}}}
+	if !reflect.DeepEqual(drainErr.Abandoned, want) {
+		t.Errorf("abandoned = %v, want %v", drainErr.Abandoned, want)
+	}
+	if !forced {
+		t.Error("phases after a cut off drain should see a forced ctx")
+	}
+	if code := ExitCode(err); code != ExitForced {
+		t.Errorf("exit code = %d, want %d", code, ExitForced)
+	}
+}
+
+func TestLifecycleForce(t *testing.T) {
+	lc := NewLifecycle()
+	lc.Append(blockingDrain(make(chan struct{})))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lc.Force()
+
+	err := lc.Stop(context.Background())
+	if !errors.Is(err, ErrForced) {
+		t.Fatalf("err = %v, want %v", err, ErrForced)
+	}
+}
+
+func TestLifecycleCleanDrain(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	lc := NewLifecycle()
+	lc.DrainTimeout = time.Second
+	lc.Append(blockingDrain(release))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err := lc.Stop(context.Background())
+	if code := ExitCode(err); code != ExitClean {
+		t.Errorf("exit code = %d, want %d (err=%v)", code, ExitClean, err)
+	}
+}
+
+func TestLifecycleCancelDrain(t *testing.T) {
+	var calls []string
+	admission := recordHook(&calls, "admission", PhaseStopAdmission)
+	admission.OnResume = func(ctx context.Context) error {
+		calls = append(calls, "resume admission")
+		return nil
+	}
+	lc := NewLifecycle()
+	var transitions []string
+	lc.OnTransition(func(from, to State) {
+		transitions = append(transitions, to.String())
+	})
+	lc.Append(
+		admission,
+		recordHook(&calls, "http", PhaseCloseConsumers),
+		blockingDrain(make(chan struct{})),
+	)
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.CancelDrain(); !errors.Is(err, ErrNotDraining) {
+		t.Fatalf("CancelDrain while serving = %v, want %v", err, ErrNotDraining)
+	}
+
+	lc.OnTransition(func(from, to State) {
+		if to == StateDraining {
+			go lc.CancelDrain()
+		}
+	})
+	if err := lc.Stop(context.Background()); !errors.Is(err, ErrDrainCanceled) {
+		t.Fatalf("Stop = %v, want %v", err, ErrDrainCanceled)
+	}
+	if state, _ := lc.State(); state != StateServing {
+		t.Errorf("state = %s, want %s", state, StateServing)
+	}
+	want := []string{"start admission", "start http", "stop admission", "resume admission"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	wantTransitions := []string{"starting", "serving", "draining", "serving"}
+	if !reflect.DeepEqual(transitions, wantTransitions) {
+		t.Errorf("transitions = %v, want %v", transitions, wantTransitions)
+	}
+}
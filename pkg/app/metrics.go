@@ -0,0 +1,118 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+const MetricsPath = "/metrics"
+
+// Metrics counts the rejections by reason, see the Reason* constants, and
+// the expired uploads.
+type Metrics struct {
+	mu       sync.Mutex
+	rejected map[string]uint64
+	expired  uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{rejected: map[string]uint64{}}
+}
+
+// Rejected counts a rejection for reason.
+func (m *Metrics) Rejected(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected[reason]++
+}
+
+// Expired counts an upload removed by the janitor.
+func (m *Metrics) Expired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expired++
+}
+
+// ExpiredUploads returns the uploads removed so far.
+func (m *Metrics) ExpiredUploads() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expired
+}
+
+// Rejections returns the rejections counted so far by reason.
+func (m *Metrics) Rejections() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]uint64, len(m.rejected))
+	for reason, n := range m.rejected {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// RegisterMetricsHandler serves the rejections, the work in flight and the
+// resource pressure of appCtx on MetricsPath in the Prometheus text format.
+func RegisterMetricsHandler(e *echo.Echo, appCtx *Context) {
+	e.GET(MetricsPath, func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+		c.Response().WriteHeader(http.StatusOK)
+		writeMetrics(c.Response(), appCtx)
+		return nil
+	})
+}
+
+func writeMetrics(w io.Writer, appCtx *Context) {
+	m := appCtx.GracefulTUSManager
+	if m != nil {
+		counts := m.Metrics().Rejections()
+		reasons := make([]string, 0, len(counts))
+		for reason := range counts {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		fmt.Fprintln(w, "# HELP graceful_rejections_total Requests and uploads rejected, by reason.")
+		fmt.Fprintln(w, "# TYPE graceful_rejections_total counter")
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "graceful_rejections_total{reason=%q} %d\n", reason, counts[reason])
+		}
+		fmt.Fprintln(w, "# HELP graceful_uploads_expired_total Incomplete uploads removed after their TTL.")
+		fmt.Fprintln(w, "# TYPE graceful_uploads_expired_total counter")
+		fmt.Fprintf(w, "graceful_uploads_expired_total %d\n", m.Metrics().ExpiredUploads())
+	}
+
+	if appCtx.Tracker != nil {
+		fmt.Fprintln(w, "# HELP graceful_in_flight Work in flight, by kind.")
+		fmt.Fprintln(w, "# TYPE graceful_in_flight gauge")
+		for _, kind := range []string{KindUpload, KindTranscode, KindRequest} {
+			fmt.Fprintf(w, "graceful_in_flight{kind=%q} %d\n", kind, len(appCtx.Tracker.IDs(kind)))
+		}
+	}
+
+	if m == nil {
+		return
+	}
+	receiving := 0
+	if m.IsReceivingRequest() {
+		receiving = 1
+	}
+	p := m.Pressure()
+	gauges := []struct {
+		name, help string
+		value      interface{}
+	}{
+		{"graceful_receiving", "1 while new uploads are admitted.", receiving},
+		{"graceful_disk_free_bytes", "Free bytes under the store path, -1 when unknown.", p.DiskFree},
+		{"graceful_heap_bytes", "Allocated heap bytes.", p.HeapBytes},
+		{"graceful_goroutines", "Number of goroutines.", p.Goroutines},
+		{"graceful_upload_throughput_bytes", "Measured rate of an upload in bytes per second, 0 when unknown.", p.Throughput},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.value)
+	}
+}
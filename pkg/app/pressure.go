@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Reasons of the rejected uploads, as reported in the rejection body and
+// counted by Metrics.
+const (
+	ReasonDraining   = "draining"
+	ReasonDisk       = "disk"
+	ReasonUploads    = "uploads"
+	ReasonMemory     = "memory"
+	ReasonGoroutines = "goroutines"
+	ReasonDeadline   = "deadline"
+)
+
+// PressureConfig sets the thresholds past which new uploads are shed, a zero
+// threshold is not checked.
+type PressureConfig struct {
+	// Dir is the store path, a new upload needs its Upload-Length plus
+	// DiskMargin bytes free under it.
+	Dir        string
+	DiskMargin int64
+	// MaxUploads bounds the uploads in flight.
+	MaxUploads int
+	// MaxHeapBytes and MaxGoroutines bound the process.
+	MaxHeapBytes  uint64
+	MaxGoroutines int
+	// FitDrainWindow refuses the uploads which would not complete within
+	// the drain window at the measured upload rate.
+	FitDrainWindow bool
+}
+
+// Pressure is the state the thresholds are checked against.
+type Pressure struct {
+	DiskFree   int64
+	Uploads    int
+	HeapBytes  uint64
+	Goroutines int
+	// Throughput is the measured rate of an upload in bytes per second,
+	// zero when unknown. DrainWindow is the time left to complete an upload
+	// admitted now, zero when unbounded.
+	Throughput  float64
+	DrainWindow time.Duration
+}
+
+// ReadPressure reads the free space under cfg.Dir and the runtime counters,
+// uploads is the number of uploads in flight.
+func ReadPressure(cfg PressureConfig, uploads int) Pressure {
+	p := Pressure{
+		DiskFree:   -1,
+		Uploads:    uploads,
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if cfg.Dir != "" {
+		if free, err := diskFree(cfg.Dir); err == nil {
+			p.DiskFree = free
+		}
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p.HeapBytes = ms.HeapAlloc
+	return p
+}
+
+// Shed returns the reason to shed an upload of size bytes, the status to
+// answer it with and what was exceeded, an empty reason admits it. A
+// negative size, deferred length, only needs the margin.
+func (cfg PressureConfig) Shed(p Pressure, size int64) (string, int, string) {
+	if size < 0 {
+		size = 0
+	}
+	switch {
+	case cfg.MaxUploads > 0 && p.Uploads >= cfg.MaxUploads:
+		return ReasonUploads, http.StatusServiceUnavailable,
+			fmt.Sprintf("%d uploads in flight, the limit is %d", p.Uploads, cfg.MaxUploads)
+	case cfg.Dir != "" && p.DiskFree >= 0 && p.DiskFree < size+cfg.DiskMargin:
+		return ReasonDisk, http.StatusInsufficientStorage,
+			fmt.Sprintf("%d bytes free, %d needed", p.DiskFree, size+cfg.DiskMargin)
+	case cfg.FitDrainWindow && p.Throughput > 0 && p.DrainWindow > 0 &&
+		float64(size)/p.Throughput > p.DrainWindow.Seconds():
+		return ReasonDeadline, http.StatusServiceUnavailable,
+			fmt.Sprintf("%d bytes take about %s at %.0f bytes/s, the drain window is %s",
+				size, time.Duration(float64(size)/p.Throughput*float64(time.Second)).Round(time.Second), p.Throughput, p.DrainWindow)
+	case cfg.MaxHeapBytes > 0 && p.HeapBytes > cfg.MaxHeapBytes:
+		return ReasonMemory, http.StatusServiceUnavailable,
+			fmt.Sprintf("heap at %d bytes, the limit is %d", p.HeapBytes, cfg.MaxHeapBytes)
+	case cfg.MaxGoroutines > 0 && p.Goroutines > cfg.MaxGoroutines:
+		return ReasonGoroutines, http.StatusServiceUnavailable,
+			fmt.Sprintf("%d goroutines, the limit is %d", p.Goroutines, cfg.MaxGoroutines)
+	}
+	return "", 0, ""
+}
+
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestShed(t *testing.T) {
+	cfg := PressureConfig{Dir: "/store", DiskMargin: 100, MaxUploads: 2, MaxHeapBytes: 1000, MaxGoroutines: 50, FitDrainWindow: true}
+	idle := Pressure{DiskFree: 1000, Uploads: 1, HeapBytes: 500, Goroutines: 10}
+	tests := []struct {
+		name       string
+		p          func(p Pressure) Pressure
+		size       int64
+		wantReason string
+		wantStatus int
+	}{
+		{"idle", func(p Pressure) Pressure { return p }, 500, "", 0},
+		{"deferred length", func(p Pressure) Pressure { return p }, -1, "", 0},
+		{"disk unknown", func(p Pressure) Pressure { p.DiskFree = -1; return p }, 5000, "", 0},
+		{"too large", func(p Pressure) Pressure { return p }, 901, ReasonDisk, http.StatusInsufficientStorage},
+		{"margin only", func(p Pressure) Pressure { p.DiskFree = 50; return p }, -1, ReasonDisk, http.StatusInsufficientStorage},
+		{"uploads", func(p Pressure) Pressure { p.Uploads = 2; return p }, 0, ReasonUploads, http.StatusServiceUnavailable},
+		{"uploads first", func(p Pressure) Pressure { p.Uploads = 2; p.DiskFree = 0; return p }, 0, ReasonUploads, http.StatusServiceUnavailable},
+		{"heap", func(p Pressure) Pressure { p.HeapBytes = 1001; return p }, 0, ReasonMemory, http.StatusServiceUnavailable},
+		{"goroutines", func(p Pressure) Pressure { p.Goroutines = 51; return p }, 0, ReasonGoroutines, http.StatusServiceUnavailable},
+		{"fits the drain window", func(p Pressure) Pressure { p.Throughput = 10; p.DrainWindow = time.Minute; return p }, 600, "", 0},
+		{"past the drain window", func(p Pressure) Pressure { p.Throughput = 10; p.DrainWindow = time.Minute; return p }, 601, ReasonDeadline, http.StatusServiceUnavailable},
+		{"throughput unknown", func(p Pressure) Pressure { p.DrainWindow = time.Minute; return p }, 601, "", 0},
+		{"no drain timeout", func(p Pressure) Pressure { p.Throughput = 10; return p }, 601, "", 0},
+	}
+	for _, tt := range tests {
+		reason, status, _ := cfg.Shed(tt.p(idle), tt.size)
+		if reason != tt.wantReason || status != tt.wantStatus {
+			t.Errorf("%s: Shed = %q %d, want %q %d", tt.name, reason, status, tt.wantReason, tt.wantStatus)
+		}
+	}
+	if reason, _, _ := (PressureConfig{}).Shed(Pressure{Uploads: 100, HeapBytes: 1 << 40, Goroutines: 1 << 20}, 1<<40); reason != "" {
+		t.Errorf("zero config shed %q", reason)
+	}
+}
+
+func TestAdmitUpload(t *testing.T) {
+	tracker := NewWorkTracker()
+	m := NewShutdownManage(WithTracker(tracker), WithPressure(PressureConfig{MaxUploads: 1}))
+	m.StartReceivingRequest()
+	if rej := m.AdmitUpload("", "/files", 10); rej != nil {
+		t.Fatalf("AdmitUpload = %+v, want admitted", rej)
+	}
+	m.StartNewUpload("upload-1")
+	rej := m.AdmitUpload("", "/files", 10)
+	if rej == nil || rej.Reason != ReasonUploads || rej.Status != http.StatusServiceUnavailable {
+		t.Fatalf("AdmitUpload with upload-1 running = %+v, want shed on uploads", rej)
+	}
+	m.StopReceivingRequest()
+	if rej := m.AdmitUpload("", "/files", 10); rej == nil || rej.Error != "draining" {
+		t.Fatalf("AdmitUpload while draining = %+v, want the drain rejection", rej)
+	}
+
+	e := echo.New()
+	RegisterMetricsHandler(e, &Context{GracefulTUSManager: m, Tracker: tracker})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	for _, want := range []string{
+		`graceful_rejections_total{reason="draining"} 1`,
+		`graceful_rejections_total{reason="uploads"} 1`,
+		`graceful_in_flight{kind="upload"} 1`,
+		"graceful_receiving 0",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics miss %q:\n%s", want, rec.Body)
+		}
+	}
+}
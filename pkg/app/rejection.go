@@ -0,0 +1,116 @@
+package app
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RejectionConfig describes the hints sent to the clients rejected during the drain.
+type RejectionConfig struct {
+	// RetryAfter is sent as the Retry-After header, zero omits it.
+	RetryAfter time.Duration
+	// Peers are the base URLs of the nodes to send the clients to,
+	// e.g. "http://upload-2:8180".
+	Peers []string
+	// PeerHeader carries the chosen peer, e.g. "X-Upload-Peer", empty omits it.
+	PeerHeader string
+	// SetLocation points the Location header to the request URI on the chosen peer.
+	SetLocation bool
+}
+
+// Rejection is the JSON body sent to the clients rejected during the drain
+// or shed under resource pressure.
+type Rejection struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// Reason tells why an upload was shed, see the Reason* constants.
+	Reason            string `json:"reason,omitempty"`
+	RetryAfterSeconds int    `json:"retry_after_seconds,omitempty"`
+	Peer              string `json:"peer,omitempty"`
+	// Location is the request URI on Peer and Status the status code to
+	// answer with, they are not part of the body.
+	Location string `json:"-"`
+	Status   int    `json:"-"`
+}
+
+// NewRejection builds the rejection of a request. The peer is picked from a
+// hash of the request so that the headers and the body agree on it.
+func (c RejectionConfig) NewRejection(remoteAddr, requestURI string) Rejection {
+	rej := Rejection{
+		Error:             "draining",
+		Message:           "server is draining, retry later or on the peer",
+		RetryAfterSeconds: int(c.RetryAfter.Seconds()),
+		Status:            http.StatusServiceUnavailable,
+	}
+	if len(c.Peers) > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(remoteAddr + requestURI))
+		rej.Peer = strings.TrimSuffix(c.Peers[h.Sum32()%uint32(len(c.Peers))], "/")
+		rej.Location = rej.Peer + requestURI
+	}
+	return rej
+}
+
+// SetHeaders writes the Retry-After and peer headers of rej to header.
+func (c RejectionConfig) SetHeaders(header http.Header, rej Rejection) {
+	if rej.RetryAfterSeconds > 0 {
+		header.Set("Retry-After", strconv.Itoa(rej.RetryAfterSeconds))
+	}
+	if rej.Peer == "" {
+		return
+	}
+	if c.PeerHeader != "" {
+		header.Set(c.PeerHeader, rej.Peer)
+	}
+	if c.SetLocation {
+		header.Set(echo.HeaderLocation, rej.Location)
+	}
+}
+
+// Body returns rej as JSON.
+func (rej Rejection) Body() []byte {
+	body, _ := json.Marshal(rej)
+	return body
+}
+
+// RejectionConfig returns the hints configured with WithRejection.
+func (s *GracefulManager) RejectionConfig() RejectionConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejection
+}
+
+// reject answers 503 with the rejection hints.
+func (s *GracefulManager) reject(c echo.Context) error {
+	cfg := s.RejectionConfig()
+	rej := cfg.NewRejection(c.Request().RemoteAddr, c.Request().RequestURI)
+	cfg.SetHeaders(c.Response().Header(), rej)
+	s.metrics.Rejected(ReasonDraining)
+	// The retry goes through a new connection, it may land on a peer or
+	// on the process which took the listener over.
+	c.Response().Header().Set(echo.HeaderConnection, "close")
+	return c.JSONBlob(http.StatusServiceUnavailable, rej.Body())
+}
+
+// addRejectionHeaders adds the hints to the 503 and 507 answers written by the
+// handlers themselves, i.e. tusd rejecting an upload creation in its callback.
+// tusd sends the Rejection body of the callback error as text/plain.
+func (s *GracefulManager) addRejectionHeaders(c echo.Context) {
+	res := c.Response()
+	res.Before(func() {
+		if res.Status != http.StatusServiceUnavailable && res.Status != http.StatusInsufficientStorage {
+			return
+		}
+		cfg := s.RejectionConfig()
+		cfg.SetHeaders(res.Header(), cfg.NewRejection(c.Request().RemoteAddr, c.Request().RequestURI))
+		if strings.HasPrefix(res.Header().Get(echo.HeaderContentType), echo.MIMETextPlain) {
+			res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRejectionHints(t *testing.T) {
+	m := NewShutdownManage(WithRejection(RejectionConfig{
+		RetryAfter:  5 * time.Second,
+		Peers:       []string{"http://peer:8180/"},
+		PeerHeader:  "X-Upload-Peer",
+		SetLocation: true,
+	}))
+	e := echo.New()
+	e.Use(m.EchoMiddleware())
+	e.POST("/files", func(c echo.Context) error {
+		return c.NoContent(http.StatusCreated)
+	})
+	m.StopReceivingRequest()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/files", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want 5", got)
+	}
+	if got := rec.Header().Get("X-Upload-Peer"); got != "http://peer:8180" {
+		t.Errorf("X-Upload-Peer = %q, want http://peer:8180", got)
+	}
+	if got := rec.Header().Get(echo.HeaderLocation); got != "http://peer:8180/files" {
+		t.Errorf("Location = %q, want http://peer:8180/files", got)
+	}
+	var rej Rejection
+	if err := json.Unmarshal(rec.Body.Bytes(), &rej); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if rej.Error != "draining" || rej.RetryAfterSeconds != 5 || rej.Peer != "http://peer:8180" {
+		t.Errorf("body = %+v", rej)
+	}
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/davidtrse/graceful/log"
+)
+
+// SignalAction is what Run does on a signal.
+type SignalAction string
+
+const (
+	// SignalDrain starts the graceful shutdown, during the drain it
+	// forces the shutdown.
+	SignalDrain SignalAction = "drain"
+	// SignalStop shuts down without waiting for the work in flight.
+	SignalStop SignalAction = "stop"
+	// SignalReload runs the OnReload hooks.
+	SignalReload SignalAction = "reload"
+	// SignalReopenLogs opens the log files again after a rotation.
+	SignalReopenLogs SignalAction = "reopen-logs"
+	// SignalDumpState writes the state, the work in flight and the
+	// goroutines to stderr.
+	SignalDumpState SignalAction = "dump-state"
+	// SignalUpgrade hands the listener over to a new process, see Upgrader.
+	SignalUpgrade SignalAction = "upgrade"
+	// SignalResume cancels the drain, see CancelDrain.
+	SignalResume SignalAction = "resume"
+	// SignalIgnore only logs the signal, which no longer has its default
+	// effect on the process.
+	SignalIgnore SignalAction = "ignore"
+)
+
+var signalActions = []SignalAction{
+	SignalDrain, SignalStop, SignalReload, SignalReopenLogs,
+	SignalDumpState, SignalUpgrade, SignalResume, SignalIgnore,
+}
+
+// SignalPolicy maps the signals Run listens to to their action.
+type SignalPolicy map[os.Signal]SignalAction
+
+// DefaultSignalPolicy drains on SIGTERM, which Kubernetes and Docker send,
+// and on SIGINT. SIGHUP is ignored instead of tearing the server down, the
+// servers have no OnReload hook: their configuration comes from the
+// environment, which does not change in a running process. No
+// signal resumes by default: systemd sends SIGCONT right after the stop
+// signal, and so do job control and the debuggers.
+func DefaultSignalPolicy() SignalPolicy {
+	return SignalPolicy{
+		syscall.SIGTERM: SignalDrain,
+		syscall.SIGINT:  SignalDrain,
+		syscall.SIGQUIT: SignalStop,
+		syscall.SIGHUP:  SignalIgnore,
+		syscall.SIGUSR1: SignalReopenLogs,
+		syscall.SIGUSR2: SignalUpgrade,
+	}
+}
+
+// ParseSignalPolicy applies to base a comma separated list of overrides
+// such as "HUP=ignore,SIGQUIT=dump-state" and returns the result.
+func ParseSignalPolicy(base SignalPolicy, overrides string) (SignalPolicy, error) {
+	p := make(SignalPolicy, len(base))
+	for s, a := range base {
+		p[s] = a
+	}
+	for _, kv := range strings.Split(overrides, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("signal policy %q: want SIGNAL=action", kv)
+		}
+		s, ok := signalNames[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")]
+		if !ok {
+			return nil, fmt.Errorf("signal policy %q: unknown signal", kv)
+		}
+		a := SignalAction(strings.TrimSpace(action))
+		if !a.valid() {
+			return nil, fmt.Errorf("signal policy %q: unknown action", kv)
+		}
+		p[s] = a
+	}
+	return p, nil
+}
+
+var signalNames = map[string]os.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"CONT":  syscall.SIGCONT,
+	"WINCH": syscall.SIGWINCH,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+}
+
+func (a SignalAction) valid() bool {
+	for _, known := range signalActions {
+		if a == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Action returns the action of s, SignalIgnore when it is not mapped.
+func (p SignalPolicy) Action(s os.Signal) SignalAction {
+	if a, ok := p[s]; ok {
+		return a
+	}
+	return SignalIgnore
+}
+
+// Signals returns the signals mapped to one of actions, to any action
+// when none is given, sorted by number.
+func (p SignalPolicy) Signals(actions ...SignalAction) []os.Signal {
+	var signals []os.Signal
+	for s, a := range p {
+		if len(actions) == 0 || hasAction(actions, a) {
+			signals = append(signals, s)
+		}
+	}
+	sort.Slice(signals, func(i, j int) bool {
+		return signalNumber(signals[i]) < signalNumber(signals[j])
+	})
+	return signals
+}
+
+func hasAction(actions []SignalAction, a SignalAction) bool {
+	for _, want := range actions {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
+
+func signalNumber(s os.Signal) int {
+	if n, ok := s.(syscall.Signal); ok {
+		return int(n)
+	}
+	return -1
+}
+
+// handleSignal runs the actions which neither start nor force a shutdown.
+func (l *Lifecycle) handleSignal(ctx context.Context, s os.Signal, a SignalAction) {
+	switch a {
+	case SignalReload:
+		log.Infof("lifecycle: received %s, reloading", s)
+		if err := l.Reload(ctx); err != nil {
+			log.Errorf("lifecycle: reload failed, err=%s", err)
+		}
+	case SignalReopenLogs:
+		log.Infof("lifecycle: received %s, reopening the logs", s)
+		reopen := l.ReopenLogs
+		if reopen == nil {
+			reopen = log.Reopen
+		}
+		if err := reopen(); err != nil {
+			log.Errorf("lifecycle: reopen the logs failed, err=%s", err)
+		}
+	case SignalDumpState:
+		log.Infof("lifecycle: received %s, dumping the state", s)
+		l.DumpState(os.Stderr)
+	default:
+		state, _ := l.State()
+		log.Infof("lifecycle: received %s, ignored in state %s", s, state)
+	}
+}
+
+// Reload runs the OnReload hooks of the started hooks in start order and
+// returns the first error, a failing hook does not prevent the others from
+// reloading.
+func (l *Lifecycle) Reload(ctx context.Context) error {
+	l.mu.Lock()
+	started := l.started
+	l.mu.Unlock()
+
+	var firstErr error
+	for _, h := range started {
+		if h.OnReload == nil {
+			continue
+		}
+		log.Infof("lifecycle: reloading %s", h.Name)
+		if err := h.OnReload(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("reload %s: %w", h.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// DumpState writes the state, the work in flight of every hook and the
+// stacks of the goroutines to w.
+func (l *Lifecycle) DumpState(w io.Writer) {
+	state, since := l.State()
+	fmt.Fprintf(w, "lifecycle: %s since %s\n", state, since.Format("2006-01-02T15:04:05.000Z07:00"))
+	l.mu.Lock()
+	hooks := l.hooks
+	l.mu.Unlock()
+	for _, h := range hooks {
+		if h.InFlight != nil {
+			fmt.Fprintf(w, "lifecycle: %s in flight: %v\n", h.Name, h.InFlight())
+		}
+	}
+	pprof.Lookup("goroutine").WriteTo(w, 1)
+}
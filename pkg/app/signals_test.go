@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignalPolicy(t *testing.T) {
+	p, err := ParseSignalPolicy(DefaultSignalPolicy(), " HUP=reload, SIGQUIT=dump-state,usr1=drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sig  os.Signal
+		want SignalAction
+	}{
+		{syscall.SIGTERM, SignalDrain},
+		{syscall.SIGHUP, SignalReload},
+		{syscall.SIGQUIT, SignalDumpState},
+		{syscall.SIGUSR1, SignalDrain},
+		{syscall.SIGWINCH, SignalIgnore},
+		{syscall.SIGCONT, SignalIgnore},
+	}
+	for _, tt := range tests {
+		if got := p.Action(tt.sig); got != tt.want {
+			t.Errorf("Action(%s) = %s, want %s", tt.sig, got, tt.want)
+		}
+	}
+	want := []os.Signal{syscall.SIGINT, syscall.SIGUSR1, syscall.SIGTERM}
+	if got := p.Signals(SignalDrain); !reflect.DeepEqual(got, want) {
+		t.Errorf("Signals(drain) = %v, want %v", got, want)
+	}
+	if DefaultSignalPolicy().Action(syscall.SIGHUP) != SignalIgnore {
+		t.Error("the base policy was changed")
+	}
+
+	for _, overrides := range []string{"HUP", "KILL=drain", "HUP=restart"} {
+		if _, err := ParseSignalPolicy(DefaultSignalPolicy(), overrides); err == nil {
+			t.Errorf("ParseSignalPolicy(%q) succeeded", overrides)
+		}
+	}
+}
+
+func TestLifecycleReload(t *testing.T) {
+	var reloaded []string
+	reload := func(name string, err error) Hook {
+		return Hook{Name: name, OnReload: func(ctx context.Context) error {
+			reloaded = append(reloaded, name)
+			return err
+		}}
+	}
+	broken := errors.New("broken")
+	lc := NewLifecycle()
+	lc.Append(reload("first", broken), Hook{Name: "static"}, reload("second", nil))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.Reload(context.Background()); !errors.Is(err, broken) {
+		t.Errorf("Reload = %v, want %v", err, broken)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(reloaded, want) {
+		t.Errorf("reloaded %v, want %v", reloaded, want)
+	}
+}
+
+// processSignals delivers the signals like the OS does, only to the channels
+// notified of them.
+type processSignals struct {
+	mu       sync.Mutex
+	subs     map[chan<- os.Signal][]os.Signal
+	notified chan struct{}
+}
+
+func (s *processSignals) Notify(c chan<- os.Signal, sig ...os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[c] = append(s.subs[c], sig...)
+	close(s.notified)
+}
+
+func (s *processSignals) Stop(c chan<- os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, c)
+}
+
+func (s *processSignals) send(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, sigs := range s.subs {
+		for _, want := range sigs {
+			if want == sig {
+				c <- sig
+			}
+		}
+	}
+}
+
+func TestLifecycleStopFollowedByContinue(t *testing.T) {
+	signals := &processSignals{subs: map[chan<- os.Signal][]os.Signal{}, notified: make(chan struct{})}
+	drained := make(chan struct{})
+	lc := NewLifecycle()
+	lc.SignalSource = signals
+	lc.Append(blockingDrain(drained))
+	var mu sync.Mutex
+	var transitions []string
+	draining := make(chan struct{}, 1)
+	lc.OnTransition(func(from, to State) {
+		mu.Lock()
+		transitions = append(transitions, to.String())
+		mu.Unlock()
+		if to == StateDraining {
+			draining <- struct{}{}
+		}
+	})
+	done := make(chan error, 1)
+	go func() { done <- lc.Run(context.Background()) }()
+	<-signals.notified
+
+	// systemctl stop sends SIGCONT right after SIGTERM, the drain may
+	// have started already. The signals are read one at a time, the
+	// second SIGHUP is delivered once SIGCONT was handled.
+	signals.send(syscall.SIGTERM)
+	<-draining
+	signals.send(syscall.SIGCONT)
+	signals.send(syscall.SIGHUP)
+	signals.send(syscall.SIGHUP)
+	close(drained)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run = %v, want the drain to complete", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the drain was canceled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"starting", "serving", "draining", "stopping", "stopped"}
+	if !reflect.DeepEqual(transitions, want) {
+		t.Errorf("transitions = %v, want %v", transitions, want)
+	}
+}
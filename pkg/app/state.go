@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+)
+
+// State is where a Lifecycle is, the transitions are:
+//
+//	idle -> starting -> serving -> [queued ->] draining -> stopping -> stopped
+//	queued, draining -> serving when the drain is canceled
+type State int
+
+const (
+	StateIdle State = iota
+	StateStarting
+	StateServing
+	// StateQueued waits for the Coordinator to let the node drain, it
+	// still serves meanwhile.
+	StateQueued
+	// StateDraining covers the stop-admission and the drain phases, the
+	// drain can be canceled until the consumers are closed.
+	StateDraining
+	StateStopping
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateStarting:
+		return "starting"
+	case StateServing:
+		return "serving"
+	case StateQueued:
+		return "queued"
+	case StateDraining:
+		return "draining"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+var (
+	// ErrDrainCanceled is returned by Stop when CancelDrain brought the
+	// lifecycle back to serving.
+	ErrDrainCanceled = errors.New("drain canceled")
+	// ErrNotDraining is returned by CancelDrain when there is no drain to cancel.
+	ErrNotDraining = errors.New("not draining")
+)
+
+// State returns the current state and since when the lifecycle is in it.
+func (l *Lifecycle) State() (State, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state, l.since
+}
+
+// OnTransition calls f after every state change, from the goroutine which
+// made it. f must not call back into the lifecycle.
+func (l *Lifecycle) OnTransition(f func(from, to State)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.observers = append(l.observers, f)
+}
+
+// setState moves to the state to.
+func (l *Lifecycle) setState(to State) {
+	l.mu.Lock()
+	from, observers := l.swapState(to)
+	l.mu.Unlock()
+	transitioned(from, to, observers)
+	l.publishTransition(from, to)
+}
+
+// stopping moves to StateStopping unless the drain was canceled, CancelDrain
+// fails from then on.
+func (l *Lifecycle) stopping() bool {
+	l.mu.Lock()
+	if l.canceled {
+		l.mu.Unlock()
+		return false
+	}
+	from, observers := l.swapState(StateStopping)
+	l.mu.Unlock()
+	transitioned(from, StateStopping, observers)
+	return true
+}
+
+// swapState must be called with l.mu held, the observers it returns are
+// called by transitioned once l.mu is released.
+func (l *Lifecycle) swapState(to State) (State, []func(from, to State)) {
+	from := l.state
+	l.state = to
+	l.since = clock.Or(l.Clock).Now()
+	return from, l.observers
+}
+
+func transitioned(from, to State, observers []func(from, to State)) {
+	log.Infof("lifecycle: %s -> %s", from, to)
+	for _, f := range observers {
+		f(from, to)
+	}
+}
+
+// CancelDrain stops the running or queued drain and brings the lifecycle back
+// to serving: the hooks stopped so far run their OnResume and Stop returns
+// ErrDrainCanceled. It returns once the lifecycle serves again and fails
+// once the consumers are being closed, after a forced drain and during an
+// upgrade, the new process serves then.
+func (l *Lifecycle) CancelDrain() error {
+	l.mu.Lock()
+	switch {
+	case l.state != StateDraining && l.state != StateQueued:
+		l.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotDraining, l.state)
+	case l.forced:
+		l.mu.Unlock()
+		return fmt.Errorf("%w: the drain was forced", ErrNotDraining)
+	case l.upgrading:
+		l.mu.Unlock()
+		return fmt.Errorf("%w: upgrading", ErrNotDraining)
+	}
+	l.canceled = true
+	if l.forceDrain != nil {
+		l.forceDrain()
+	}
+	resumed := l.resumed
+	l.mu.Unlock()
+	<-resumed
+	return nil
+}
+
+type canceledKey struct{}
+
+// IsDrainCanceled reports whether the drain ctx belongs to was canceled by
+// CancelDrain. Hooks use it to tell a canceled drain from a cut off one.
+func IsDrainCanceled(ctx context.Context) bool {
+	canceled, _ := ctx.Value(canceledKey{}).(func() bool)
+	return canceled != nil && canceled()
+}
+
+func (l *Lifecycle) isCanceled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.canceled
+}
+
+// resume runs the OnResume hooks of the phases stopped so far in start order
+// and makes started the hooks to stop again.
+func (l *Lifecycle) resume(ctx context.Context, started []Hook) error {
+	for _, h := range started {
+		if h.Phase > PhaseDrain || h.OnResume == nil {
+			continue
+		}
+		log.Infof("lifecycle: resuming %s", h.Name)
+		if err := h.OnResume(ctx); err != nil {
+			log.Errorf("lifecycle: resume %s failed, err=%s", h.Name, err)
+		}
+	}
+	return l.serveAgain(started)
+}
+
+// serveAgain makes started the hooks to stop again and wakes up CancelDrain.
+func (l *Lifecycle) serveAgain(started []Hook) error {
+	l.mu.Lock()
+	l.started = started
+	l.canceled = false
+	l.forceDrain = nil
+	l.mu.Unlock()
+	l.setState(StateServing)
+	close(l.resumed)
+	return ErrDrainCanceled
+}
+
+const (
+	LifecyclePath       = "/lifecycle"
+	LifecycleResumePath = "/lifecycle/resume"
+)
+
+// LifecycleStatus is served on LifecyclePath.
+type LifecycleStatus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+}
+
+// RegisterLifecycleHandlers serves the state of l on LifecyclePath and cancels
+// its drain on POST LifecycleResumePath, 409 when there is no drain to cancel.
+// auth, e.g. AdminAuth, guards the cancelation, which is not served when nil.
+func RegisterLifecycleHandlers(e *echo.Echo, l *Lifecycle, auth echo.MiddlewareFunc) {
+	status := func(c echo.Context, code int) error {
+		state, since := l.State()
+		return c.JSON(code, LifecycleStatus{State: state.String(), Since: since})
+	}
+	e.GET(LifecyclePath, func(c echo.Context) error {
+		return status(c, http.StatusOK)
+	})
+	if auth == nil {
+		return
+	}
+	e.POST(LifecycleResumePath, func(c echo.Context) error {
+		if err := l.CancelDrain(); err != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		log.Infof("lifecycle: drain canceled by %s", c.RealIP())
+		return status(c, http.StatusAccepted)
+	}, auth)
+}
+
+// IsLifecyclePath reports whether path is served by RegisterLifecycleHandlers.
+func IsLifecyclePath(path string) bool {
+	return path == LifecyclePath || path == LifecycleResumePath
+}
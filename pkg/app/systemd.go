@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+)
+
+const (
+	// listenFdsStart is the first fd passed by systemd socket activation.
+	listenFdsStart = 3
+
+	// statusInterval refreshes STATUS= when systemd does not ask for a watchdog.
+	statusInterval = 5 * time.Second
+)
+
+// systemdListener returns the first socket passed by systemd socket activation,
+// nil when the process was not socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n < 1 {
+		return nil, nil
+	}
+	// Our own children must not believe they were socket activated.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(listenFdsStart)
+	f := os.NewFile(listenFdsStart, "systemd")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd: socket activation: %w", err)
+	}
+	if n > 1 {
+		log.Infof("systemd: %d sockets passed, only the first one is served", n)
+	}
+	return ln, nil
+}
+
+// Notifier sends sd_notify messages to the NOTIFY_SOCKET of systemd. Every
+// method is a no-op when the process is not run by a Type=notify unit.
+type Notifier struct {
+	addr     string
+	watchdog time.Duration
+}
+
+// NewNotifier reads NOTIFY_SOCKET and WATCHDOG_USEC from the environment.
+func NewNotifier() *Notifier {
+	n := &Notifier{addr: os.Getenv("NOTIFY_SOCKET")}
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// Enabled reports whether the process is run by a Type=notify unit.
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.addr != ""
+}
+
+// WatchdogInterval returns how often WATCHDOG=1 must be sent, zero when
+// the unit has no watchdog. It is half of WATCHDOG_USEC as sd_notify advises.
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if !n.Enabled() {
+		return 0
+	}
+	return n.watchdog / 2
+}
+
+// Notify sends the given VAR=value assignments as one message.
+func (n *Notifier) Notify(state ...string) error {
+	if !n.Enabled() || len(state) == 0 {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd: notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return fmt.Errorf("systemd: notify: %w", err)
+	}
+	return nil
+}
+
+// uploadStatus describes the state of m for STATUS=.
+func uploadStatus(m GracefulTUSManager, draining bool) string {
+	state := "serving"
+	switch {
+	case draining || !m.DrainStartedAt().IsZero():
+		state = "draining"
+	case !m.MaintenanceSince().IsZero():
+		state = "maintenance"
+	case !m.IsReceivingRequest():
+		state = "draining"
+	}
+	return fmt.Sprintf("STATUS=%s, %d uploads in flight", state, len(m.RunningUploads()))
+}
+
+// SystemdHooks reports READY=1 once the hooks appended before it are started
+// and STOPPING=1 as the first shutdown step. Until the telemetry is flushed it
+// keeps STATUS= up to date with the uploads of m and sends WATCHDOG=1 when the
+// unit asks for it. Append it last. After an upgrade the new process reports
+// READY=1 with its MAINPID and the old one goes quiet instead of STOPPING=1,
+// which requires NotifyAccess=all in the unit. A canceled drain reports
+// READY=1 again.
+func SystemdHooks(n *Notifier, m GracefulTUSManager) []Hook {
+	if !n.Enabled() {
+		return nil
+	}
+
+	var (
+		mu   sync.Mutex
+		stop chan struct{}
+	)
+	stopLoop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stop != nil {
+			close(stop)
+			stop = nil
+		}
+	}
+	notify := func(state ...string) {
+		if err := n.Notify(state...); err != nil {
+			log.Errorf("%s", err)
+		}
+	}
+
+	return []Hook{
+		{
+			Name:  "systemd",
+			Phase: PhaseStopAdmission,
+			OnStart: func(ctx context.Context) error {
+				interval := n.WatchdogInterval()
+				watchdog := interval > 0
+				if !watchdog || interval > statusInterval {
+					interval = statusInterval
+				}
+				mu.Lock()
+				stop = make(chan struct{})
+				done := stop
+				mu.Unlock()
+
+				notify("READY=1", fmt.Sprintf("MAINPID=%d", os.Getpid()), uploadStatus(m, false))
+				go func() {
+					ticker := time.NewTicker(interval)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-ticker.C:
+							state := []string{uploadStatus(m, false)}
+							if watchdog {
+								state = append(state, "WATCHDOG=1")
+							}
+							notify(state...)
+						case <-done:
+							return
+						}
+					}
+				}()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				if IsUpgrading(ctx) {
+					// The new process owns the unit now.
+					stopLoop()
+					return nil
+				}
+				notify("STOPPING=1", uploadStatus(m, true))
+				return nil
+			},
+			OnResume: func(ctx context.Context) error {
+				notify("READY=1", uploadStatus(m, false))
+				return nil
+			},
+		},
+		{
+			Name:      "systemd.watchdog",
+			Phase:     PhaseFlushTelemetry,
+			DependsOn: []string{"systemd"},
+			OnStop: func(ctx context.Context) error {
+				stopLoop()
+				return nil
+			},
+		},
+	}
+}
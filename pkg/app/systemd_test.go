@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens like systemd does and returns the received messages.
+func fakeNotifySocket(t *testing.T) <-chan string {
+	addr := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr)
+
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+func nextMessage(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no notify message")
+	}
+	return ""
+}
+
+func TestSystemdHooks(t *testing.T) {
+	msgs := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	n := NewNotifier()
+	if got := n.WatchdogInterval(); got != 10*time.Millisecond {
+		t.Fatalf("WatchdogInterval() = %s, want 10ms", got)
+	}
+
+	m := NewShutdownManage()
+	lc := NewLifecycle()
+	lc.Append(TUSHooks(m)...)
+	lc.Append(SystemdHooks(n, m)...)
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.StartNewUpload("upload-1")
+
+	if msg := nextMessage(t, msgs); !strings.Contains(msg, "READY=1") || !strings.Contains(msg, "STATUS=serving") {
+		t.Errorf("first message = %q, want READY=1 while serving", msg)
+	}
+	if msg := nextMessage(t, msgs); !strings.Contains(msg, "WATCHDOG=1") || !strings.Contains(msg, "1 uploads in flight") {
+		t.Errorf("periodic message = %q, want WATCHDOG=1 with the upload", msg)
+	}
+
+	m.DoneUpload("upload-1")
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg := nextMessage(t, msgs)
+		if strings.Contains(msg, "STOPPING=1") {
+			if !strings.Contains(msg, "STATUS=draining") {
+				t.Errorf("stop message = %q, want STATUS=draining", msg)
+			}
+			break
+		}
+	}
+}
+
+func TestSystemdHooksDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if hooks := SystemdHooks(NewNotifier(), NewShutdownManage()); len(hooks) != 0 {
+		t.Errorf("SystemdHooks without NOTIFY_SOCKET = %d hooks, want none", len(hooks))
+	}
+}
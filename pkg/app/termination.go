@@ -0,0 +1,64 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/labstack/echo/v4"
+)
+
+// TerminationTokenHeader carries the token of an upload, the creation
+// answers it and the termination requires it.
+const TerminationTokenHeader = "Upload-Termination-Token"
+
+// TerminationToken returns the token allowing to terminate the upload id,
+// the hex HMAC-SHA256 of id. The nodes sharing secret accept the tokens of
+// each other.
+func TerminationToken(secret, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IssueTerminationTokens answers the creation of an upload with its
+// TerminationTokenHeader, only the client which created it may terminate it.
+func IssueTerminationTokens(secret string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Before(func() {
+				if location := res.Header().Get(echo.HeaderLocation); location != "" {
+					res.Header().Set(TerminationTokenHeader, TerminationToken(secret, path.Base(location)))
+				}
+			})
+			return next(c)
+		}
+	}
+}
+
+// TerminationAuth admits the termination of the upload of the route param
+// fileID with its TerminationTokenHeader or with the admin token, the
+// others get 403. An empty adminToken only admits the upload tokens.
+func TerminationAuth(secret, adminToken string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Param(tusParam)
+			token := c.Request().Header.Get(TerminationTokenHeader)
+			admin := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			switch {
+			case token != "" && hmac.Equal([]byte(token), []byte(TerminationToken(secret, id))):
+			case adminToken != "" && subtle.ConstantTimeCompare([]byte(admin), []byte(adminToken)) == 1:
+				log.Infof("termination: upload %s terminated by the admin from %s", id, c.RealIP())
+			default:
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "forbidden"})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/davidtrse/graceful/log"
+)
+
+const (
+	// upgradeEnv is set for the process started by Upgrade, the inherited
+	// listener is fd 3 and the readiness pipe fd 4.
+	upgradeEnv = "GRACEFUL_UPGRADE"
+
+	upgradeListenerFd = 3
+	upgradeReadyFd    = 4
+)
+
+// Upgrader hands the listening socket over to a new build of the binary: the
+// new process accepts the new connections right away while the old one only
+// finishes its tracked work before exiting.
+type Upgrader struct {
+	mu sync.Mutex
+	ln net.Listener
+	// inherited, ready and parent are only set in a process started by Upgrade.
+	inherited net.Listener
+	ready     *os.File
+	parent    int
+}
+
+// NewUpgrader picks up the listener handed over by the parent process, if any.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{}
+	if os.Getenv(upgradeEnv) == "" {
+		return u, nil
+	}
+	// Our own children must not believe they were started by Upgrade.
+	os.Unsetenv(upgradeEnv)
+
+	ln, err := net.FileListener(os.NewFile(upgradeListenerFd, "listener"))
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: inherit listener: %w", err)
+	}
+	u.inherited = ln
+	u.ready = os.NewFile(upgradeReadyFd, "ready")
+	u.parent = os.Getppid()
+	return u, nil
+}
+
+// ParentRunning reports whether the process which started this one by
+// Upgrade still runs, it drains its own work meanwhile. The parent is gone
+// once this process is reparented.
+func (u *Upgrader) ParentRunning() bool {
+	return u.parent != 0 && os.Getppid() == u.parent
+}
+
+// SetListener makes Listen return ln instead of binding, e.g. an httptest listener.
+func (u *Upgrader) SetListener(ln net.Listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.inherited = ln
+}
+
+// Listen returns the listener inherited from the parent process or passed by
+// systemd socket activation, otherwise it binds addr.
+func (u *Upgrader) Listen(addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ln := u.inherited
+	u.inherited = nil
+	if ln == nil {
+		var err error
+		if ln, err = systemdListener(); err != nil {
+			return nil, err
+		}
+	}
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	u.ln = ln
+	return ln, nil
+}
+
+// Ready tells the parent process that this process serves, the parent then
+// starts draining. It is a no-op in a process not started by Upgrade.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ready == nil {
+		return nil
+	}
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+	_, err := u.ready.Write([]byte("ready"))
+	return err
+}
+
+// Upgrade starts the current executable with the listener and waits until
+// the new process is ready or ctx is done.
+func (u *Upgrader) Upgrade(ctx context.Context) error {
+	u.mu.Lock()
+	ln := u.ln
+	u.mu.Unlock()
+
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("upgrade: listener %T cannot be handed over", ln)
+	}
+	lnFile, err := fl.File()
+	if err != nil {
+		return fmt.Errorf("upgrade: listener file: %w", err)
+	}
+	defer lnFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: ready pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return fmt.Errorf("upgrade: executable: %w", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(childEnv(), upgradeEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles[i] becomes fd 3+i in the child.
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	err = cmd.Start()
+	// The child holds its own copy, ours must be closed to see EOF if it dies.
+	readyW.Close()
+	// Start took the descriptor of lnFile, which puts the socket shared with
+	// our listener in blocking mode: Accept would no longer return on Close.
+	if rc, rcErr := lnFile.SyscallConn(); rcErr == nil {
+		rc.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), true) })
+	}
+	if err != nil {
+		return fmt.Errorf("upgrade: start %s: %w", exe, err)
+	}
+	log.Infof("upgrade: started %s, pid=%d", exe, cmd.Process.Pid)
+	go func() {
+		err := cmd.Wait()
+		log.Infof("upgrade: process %d exited, err=%v", cmd.Process.Pid, err)
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(readyR, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("upgrade: new process exited before being ready")
+		}
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return fmt.Errorf("upgrade: waiting for the new process: %w", ctx.Err())
+	}
+}
+
+// childEnv is the environment of the new process. WATCHDOG_PID names this
+// process, the new one sends the watchdog pings once it is the main PID.
+func childEnv() []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// CloseListener stops accepting connections, the established ones are still served.
+// After an upgrade the new connections are then all accepted by the new process.
+func (u *Upgrader) CloseListener() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ln == nil {
+		return nil
+	}
+	return u.ln.Close()
+}
+
+type upgradingKey struct{}
+
+// IsUpgrading reports whether ctx belongs to a shutdown following an upgrade.
+func IsUpgrading(ctx context.Context) bool {
+	upgrading, _ := ctx.Value(upgradingKey{}).(bool)
+	return upgrading
+}
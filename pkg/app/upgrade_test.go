@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upgradedProcess is the process started by Upgrade in TestUpgrade: it
+// serves on the inherited listener, tells the parent it is ready and exits
+// on GET /exit.
+func upgradedProcess() {
+	u, err := NewUpgrader()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// The address is never bound, the listener is the inherited one.
+	ln, err := u.Listen("invalid")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	exit := make(chan struct{})
+	var once sync.Once
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "child %s parent-running=%t", ln.Addr(), u.ParentRunning())
+	})
+	mux.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(exit) })
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	if err := u.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	select {
+	case <-exit:
+	case <-time.After(30 * time.Second):
+	}
+	srv.Shutdown(context.Background())
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	if os.Getenv(upgradeEnv) != "" {
+		upgradedProcess()
+		return
+	}
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ParentRunning() {
+		t.Error("ParentRunning = true in a process not started by Upgrade")
+	}
+	if err := u.Ready(); err != nil {
+		t.Errorf("Ready = %v in a process not started by Upgrade", err)
+	}
+	ln, err := u.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "parent")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	get := func(path string) string {
+		res, err := client.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if got := get("/"); got != "parent" {
+		t.Fatalf("GET / before the upgrade = %q, want %q", got, "parent")
+	}
+
+	// The new process runs this test only, as upgradedProcess.
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestUpgrade$"}
+	defer func() { os.Args = args }()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	// Upgrade returns once the new process is ready, the parent still listens.
+	if err := u.Upgrade(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CloseListener(); err != nil {
+		t.Fatal(err)
+	}
+	// The new connections are all accepted by the new process.
+	for i := 0; i < 3; i++ {
+		if got, want := get("/"), fmt.Sprintf("child %s parent-running=true", ln.Addr()); got != want {
+			t.Errorf("GET / = %q, want %q", got, want)
+		}
+	}
+	get("/exit")
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+)
+
+// Headers of the webhook deliveries.
+const (
+	WebhookEventHeader     = "X-Graceful-Event"
+	WebhookDeliveryHeader  = "X-Graceful-Delivery"
+	WebhookSignatureHeader = "X-Graceful-Signature"
+)
+
+// WebhookConfig lists the URLs the events are posted to.
+type WebhookConfig struct {
+	URLs []string
+	// Secret signs the body, WebhookSignatureHeader is "sha256=" followed
+	// by the hex HMAC-SHA256 of the body. Unset sends no signature.
+	Secret string
+	// Attempts bounds the deliveries of an event, Backoff is the wait
+	// before the first retry and doubles with each retry.
+	Attempts int
+	Backoff  time.Duration
+	// FlushTimeout bounds Close, the events not delivered by then are
+	// dropped. It defaults to 10s.
+	FlushTimeout time.Duration
+	// Client defaults to a client with a 5s timeout.
+	Client *http.Client
+}
+
+// Webhooks posts the events of a bus to every URL as JSON, in order and
+// with retries. An event is given up after the last attempt.
+type Webhooks struct {
+	cfg  WebhookConfig
+	sub  *Subscription
+	stop chan struct{}
+	wg   sync.WaitGroup
+	// queues hand the events to the goroutine of each URL.
+	queues []chan Event
+}
+
+// webhookBuffer is the number of events waiting for the deliveries.
+const webhookBuffer = 1024
+
+// NewWebhooks subscribes to b and starts delivering, Close stops it.
+func NewWebhooks(b *EventBus, cfg WebhookConfig) *Webhooks {
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 5
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = 10 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	w := &Webhooks{cfg: cfg, sub: b.Subscribe("webhooks", webhookBuffer), stop: make(chan struct{})}
+	for _, url := range cfg.URLs {
+		q := make(chan Event, webhookBuffer)
+		w.queues = append(w.queues, q)
+		w.wg.Add(1)
+		go w.deliver(url, q)
+	}
+	w.wg.Add(1)
+	go w.fanOut()
+	return w
+}
+
+func (w *Webhooks) fanOut() {
+	defer w.wg.Done()
+	for e := range w.sub.C {
+		for _, q := range w.queues {
+			select {
+			case q <- e:
+			default:
+				log.Errorf("webhooks: queue full, dropping event %d", e.Seq)
+			}
+		}
+	}
+	for _, q := range w.queues {
+		close(q)
+	}
+}
+
+func (w *Webhooks) deliver(url string, q <-chan Event) {
+	defer w.wg.Done()
+	for e := range q {
+		select {
+		case <-w.stop:
+			log.Errorf("webhooks: stopped, event %d to %s is lost", e.Seq, url)
+			continue
+		default:
+		}
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Errorf("webhooks: marshal event %d, err=%s", e.Seq, err)
+			continue
+		}
+		backoff := w.cfg.Backoff
+	retry:
+		for attempt := 1; ; attempt++ {
+			err := w.post(url, e, body)
+			if err == nil {
+				break
+			}
+			if attempt == w.cfg.Attempts {
+				log.Errorf("webhooks: giving up event %d to %s after %d attempts, err=%s", e.Seq, url, attempt, err)
+				break
+			}
+			log.Errorf("webhooks: post event %d to %s, retrying in %s, err=%s", e.Seq, url, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-w.stop:
+				log.Errorf("webhooks: stopped, event %d to %s is lost", e.Seq, url)
+				break retry
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (w *Webhooks) post(url string, e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(e.Type))
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(e.Seq, 10))
+	if w.cfg.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(w.cfg.Secret, body))
+	}
+	res, err := w.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the WebhookSignatureHeader of body signed with secret,
+// the receivers compare it with hmac.Equal.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close stops the subscription and waits for the events published so far
+// to be delivered or given up, for FlushTimeout at most. When it expires the
+// events not delivered yet are dropped, when ctx is done or forced too and
+// ctx.Err is returned.
+func (w *Webhooks) Close(ctx context.Context) error {
+	flush, cancel := context.WithTimeout(ctx, w.cfg.FlushTimeout)
+	defer cancel()
+	w.sub.Close()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	if IsForced(ctx) {
+		close(w.stop)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-flush.Done():
+		if !IsForced(ctx) {
+			close(w.stop)
+		}
+		if ctx.Err() == nil {
+			log.Errorf("webhooks: not flushed within %s, the events left are dropped", w.cfg.FlushTimeout)
+		}
+		return ctx.Err()
+	}
+}
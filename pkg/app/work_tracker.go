@@ -0,0 +1,404 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidtrse/graceful/kafkas"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Kinds of work recorded by the WorkTracker.
+const (
+	KindUpload    = "upload"
+	KindTranscode = kafkas.TranscodeKind
+	KindRequest   = "request"
+	// KindUploadLock is an upload locked by a tus request, the lock outlives
+	// the end of the upload until the request is answered.
+	KindUploadLock = "upload_lock"
+)
+
+// WorkItem is one piece of in-flight work.
+type WorkItem struct {
+	Kind         string            `json:"kind"`
+	ID           string            `json:"id"`
+	StartedAt    time.Time         `json:"started_at"`
+	LastActivity time.Time         `json:"last_activity"`
+	Progress     int64             `json:"progress,omitempty"`
+	Total        int64             `json:"total,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// Rate is the smoothed progress per second, ETA when the item should
+	// reach Total at that rate. Both are unknown until the progress moved.
+	Rate float64    `json:"rate,omitempty"`
+	ETA  *time.Time `json:"eta,omitempty"`
+	// Stale is set by Snapshot when the item went without activity for
+	// longer than the stale window of its kind, it does not block Wait.
+	Stale bool `json:"stale"`
+}
+
+type workKey struct {
+	kind string
+	id   string
+}
+
+type trackedItem struct {
+	WorkItem
+	// gen tells apart two items begun with the same key, the done func
+	// of the first one must not end the second one.
+	gen uint64
+	// progressAt is when Progress last moved, zero before the first report.
+	progressAt time.Time
+}
+
+// rateWeight is the weight of a new sample in the smoothed rates.
+const rateWeight = 0.3
+
+// WorkTracker records the in-flight work of every kind so that the drain
+// decision covers uploads, transcodes and plain HTTP requests alike.
+type WorkTracker struct {
+	clock      clock.Clock
+	mu         sync.Mutex
+	items      map[workKey]*trackedItem
+	staleAfter map[string]time.Duration
+	// rates is the smoothed rate of the items of each kind, it outlives them.
+	rates map[string]float64
+	gen   uint64
+	// changed is closed and replaced every time an item ends,
+	// it wakes up the callers of Wait.
+	changed chan struct{}
+	// journal, when set, records the begin and the end of the items.
+	journal *Journal
+	// events, when set, publishes the begin and the end of the items of eventKinds.
+	events     *EventBus
+	eventKinds []string
+}
+
+func NewWorkTracker() *WorkTracker {
+	return &WorkTracker{
+		clock:      clock.Real,
+		items:      map[workKey]*trackedItem{},
+		staleAfter: map[string]time.Duration{},
+		rates:      map[string]float64{},
+		changed:    make(chan struct{}),
+	}
+}
+
+// SetStaleAfter lets the items of kind idle for longer than d stop blocking Wait,
+// zero never considers them stale.
+func (t *WorkTracker) SetStaleAfter(kind string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.staleAfter[kind] = d
+}
+
+// SetClock measures the activity and the stale windows on c.
+func (t *WorkTracker) SetClock(c clock.Clock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clock = clock.Or(c)
+}
+
+// Now reads the clock of the tracker.
+func (t *WorkTracker) Now() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clock.Now()
+}
+
+// SetJournal records the begin and the end of the items to j.
+func (t *WorkTracker) SetJournal(j *Journal) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.journal = j
+}
+
+// Begin records a new item and returns the func ending it. Calling the
+// func more than once, or after End, is a no-op.
+func (t *WorkTracker) Begin(kind, id string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	t.gen++
+	gen := t.gen
+	t.items[workKey{kind, id}] = &trackedItem{
+		WorkItem: WorkItem{Kind: kind, ID: id, StartedAt: now, LastActivity: now},
+		gen:      gen,
+	}
+	if t.journal != nil {
+		t.journal.begin(kind, id, now)
+	}
+	t.publishLocked(EventItemBegun, workKey{kind, id})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if it, ok := t.items[workKey{kind, id}]; ok && it.gen == gen {
+				t.endLocked(workKey{kind, id})
+			}
+		})
+	}
+}
+
+// End removes the item whatever Begin call recorded it. An item interrupted
+// in a previous process is resolved in the journal even if it was not begun.
+func (t *WorkTracker) End(kind, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.items[workKey{kind, id}]; ok {
+		t.endLocked(workKey{kind, id})
+	} else if t.journal != nil {
+		t.journal.resolve(kind, id, t.clock.Now())
+	}
+}
+
+func (t *WorkTracker) endLocked(key workKey) {
+	if t.journal != nil {
+		t.journal.end(key.kind, key.id, t.clock.Now())
+	}
+	delete(t.items, key)
+	t.publishLocked(EventItemFinished, key)
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Touch records activity on an item, keeping it from turning stale.
+func (t *WorkTracker) Touch(kind, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if it, ok := t.items[workKey{kind, id}]; ok {
+		it.LastActivity = t.clock.Now()
+	}
+}
+
+// SetProgress records the progress of an item out of total, it counts as activity.
+// The first report is the baseline of the rate, the rate is measured on the
+// next ones which moved the progress.
+func (t *WorkTracker) SetProgress(kind, id string, progress, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	it, ok := t.items[workKey{kind, id}]
+	if !ok {
+		return
+	}
+	now := t.clock.Now()
+	if it.progressAt.IsZero() || progress < it.Progress {
+		it.progressAt = now
+	} else if dt := now.Sub(it.progressAt); progress > it.Progress && dt > 0 {
+		rate := float64(progress-it.Progress) / dt.Seconds()
+		it.Rate = smoothRate(it.Rate, rate)
+		t.rates[kind] = smoothRate(t.rates[kind], rate)
+		it.progressAt = now
+	}
+	it.Progress = progress
+	it.Total = total
+	it.LastActivity = now
+}
+
+func smoothRate(old, sample float64) float64 {
+	if old == 0 {
+		return sample
+	}
+	return old + rateWeight*(sample-old)
+}
+
+// Rate returns the smoothed rate measured on the items of kind, current or
+// ended, zero before any of them progressed.
+func (t *WorkTracker) Rate(kind string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rates[kind]
+}
+
+func (t *WorkTracker) SetLabel(kind, id, key, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if it, ok := t.items[workKey{kind, id}]; ok {
+		if it.Labels == nil {
+			it.Labels = map[string]string{}
+		}
+		it.Labels[key] = value
+	}
+}
+
+func (t *WorkTracker) Has(kind, id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.items[workKey{kind, id}]
+	return ok
+}
+
+// IDs returns the sorted IDs of the items of kind.
+func (t *WorkTracker) IDs(kind string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := []string{}
+	for key := range t.items {
+		if key.kind == kind {
+			ids = append(ids, key.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Snapshot returns a copy of the items of the given kinds, of every kind when
+// none is given, the oldest first.
+func (t *WorkTracker) Snapshot(kinds ...string) []WorkItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	items := []WorkItem{}
+	for key, it := range t.items {
+		if !matchKind(key.kind, kinds) {
+			continue
+		}
+		item := it.WorkItem
+		if it.Labels != nil {
+			item.Labels = make(map[string]string, len(it.Labels))
+			for k, v := range it.Labels {
+				item.Labels[k] = v
+			}
+		}
+		if it.Rate > 0 && it.Total > it.Progress {
+			left := float64(it.Total-it.Progress) / it.Rate
+			eta := it.progressAt.Add(time.Duration(left * float64(time.Second)))
+			item.ETA = &eta
+		}
+		staleAt, ok := t.staleAtLocked(it)
+		item.Stale = ok && !staleAt.After(now)
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].StartedAt.Before(items[j].StartedAt)
+	})
+	return items
+}
+
+// Idle reports whether no item of the given kinds blocks the shutdown.
+func (t *WorkTracker) Idle(kinds ...string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	blocking, _ := t.blockingLocked(t.clock.Now(), kinds)
+	return blocking == 0
+}
+
+// Wait blocks until every item of the given kinds, of every kind when none
+// is given, ended or turned stale, or until ctx is done.
+func (t *WorkTracker) Wait(ctx context.Context, kinds ...string) error {
+	for {
+		t.mu.Lock()
+		now := t.clock.Now()
+		blocking, nextStale := t.blockingLocked(now, kinds)
+		if blocking == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		changed := t.changed
+		clk := t.clock
+		t.mu.Unlock()
+
+		if err := waitChange(ctx, clk, changed, nextStale.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+// blockingLocked counts the items of kinds which are not stale at now and
+// returns when the next of them turns stale.
+func (t *WorkTracker) blockingLocked(now time.Time, kinds []string) (int, time.Time) {
+	blocking := 0
+	var nextStale time.Time
+	for key, it := range t.items {
+		if !matchKind(key.kind, kinds) {
+			continue
+		}
+		staleAt, ok := t.staleAtLocked(it)
+		if !ok {
+			blocking++
+			continue
+		}
+		if !staleAt.After(now) {
+			continue
+		}
+		blocking++
+		if nextStale.IsZero() || staleAt.Before(nextStale) {
+			nextStale = staleAt
+		}
+	}
+	return blocking, nextStale
+}
+
+func (t *WorkTracker) staleAtLocked(it *trackedItem) (time.Time, bool) {
+	d := t.staleAfter[it.Kind]
+	if d <= 0 {
+		return time.Time{}, false
+	}
+	return it.LastActivity.Add(d), true
+}
+
+func matchKind(kind string, kinds []string) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// waitChange waits for changed to be closed, for timeout to elapse
+// (when positive) or for ctx to be done.
+func waitChange(ctx context.Context, clk clock.Clock, changed <-chan struct{}, timeout time.Duration) error {
+	var expired chan struct{}
+	if timeout > 0 {
+		expired = make(chan struct{})
+		timer := clk.AfterFunc(timeout, func() { close(expired) })
+		defer timer.Stop()
+	}
+
+	select {
+	case <-changed:
+	case <-expired:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// EchoMiddleware records every request not skipped by skipper as KindRequest
+// work, labelled with its method, its route and its X-Request-ID. The items
+// are keyed by a sequence, the client chosen X-Request-ID may be reused by
+// two requests in flight. A nil skipper tracks every request.
+func (t *WorkTracker) EchoMiddleware(skipper middleware.Skipper) echo.MiddlewareFunc {
+	if skipper == nil {
+		skipper = middleware.DefaultSkipper
+	}
+	var seq uint64
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipper(c) {
+				return next(c)
+			}
+
+			id := fmt.Sprintf("%d", atomic.AddUint64(&seq, 1))
+			done := t.Begin(KindRequest, id)
+			defer done()
+			t.SetLabel(KindRequest, id, "method", c.Request().Method)
+			t.SetLabel(KindRequest, id, "path", c.Path())
+			if requestID := c.Request().Header.Get(echo.HeaderXRequestID); requestID != "" {
+				t.SetLabel(KindRequest, id, "request_id", requestID)
+			}
+			return next(c)
+		}
+	}
+}
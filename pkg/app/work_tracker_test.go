@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+)
+
+// stepClock is the wall clock whose Now is set by the test.
+type stepClock struct {
+	clock.Clock
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time { return c.now }
+
+func TestWorkTrackerDoneFunc(t *testing.T) {
+	tracker := NewWorkTracker()
+	first := tracker.Begin(KindUpload, "a")
+	tracker.Begin(KindUpload, "a")
+
+	// The done func of a replaced item must not end its successor.
+	first()
+	if !tracker.Has(KindUpload, "a") {
+		t.Fatal("stale done func ended the second item")
+	}
+
+	tracker.End(KindUpload, "a")
+	if tracker.Has(KindUpload, "a") {
+		t.Fatal("End did not remove the item")
+	}
+}
+
+func TestWorkTrackerWaitKinds(t *testing.T) {
+	tracker := NewWorkTracker()
+	doneUpload := tracker.Begin(KindUpload, "u1")
+	tracker.Begin(KindTranscode, "t1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() {
+		waited <- tracker.Wait(ctx, KindUpload)
+	}()
+
+	doneUpload()
+	if err := <-waited; err != nil {
+		t.Fatalf("Wait(upload) = %v, the running transcode must not block it", err)
+	}
+	if tracker.Idle() {
+		t.Error("Idle() = true while a transcode is running")
+	}
+	if got := tracker.IDs(KindTranscode); !reflect.DeepEqual(got, []string{"t1"}) {
+		t.Errorf("IDs(transcode) = %v, want [t1]", got)
+	}
+}
+
+func TestWorkTrackerEchoMiddleware(t *testing.T) {
+	tracker := NewWorkTracker()
+	e := echo.New()
+	e.Use(tracker.EchoMiddleware(nil))
+
+	var seen []WorkItem
+	e.GET("/slow", func(c echo.Context) error {
+		seen = tracker.Snapshot(KindRequest)
+		return c.NoContent(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(seen) != 1 || seen[0].Labels["request_id"] != "req-1" || seen[0].Labels["path"] != "/slow" {
+		t.Fatalf("items seen by the handler = %+v, want req-1 on /slow", seen)
+	}
+	if !tracker.Idle(KindRequest) {
+		t.Error("request still tracked after the handler returned")
+	}
+}
+
+func TestWorkTrackerEchoMiddlewareSameRequestID(t *testing.T) {
+	tracker := NewWorkTracker()
+	e := echo.New()
+	e.Use(tracker.EchoMiddleware(nil))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	e.GET("/slow", func(c echo.Context) error {
+		started <- struct{}{}
+		<-release
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fast", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	slow := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	slow.Header.Set(echo.HeaderXRequestID, "same")
+	done := make(chan struct{})
+	go func() {
+		e.ServeHTTP(httptest.NewRecorder(), slow)
+		close(done)
+	}()
+	<-started
+
+	// The second request with the same ID ends without ending the first one.
+	fast := httptest.NewRequest(http.MethodGet, "/fast", nil)
+	fast.Header.Set(echo.HeaderXRequestID, "same")
+	e.ServeHTTP(httptest.NewRecorder(), fast)
+	if items := tracker.Snapshot(KindRequest); len(items) != 1 || items[0].Labels["path"] != "/slow" {
+		t.Fatalf("items after the second request = %+v, want the slow one", items)
+	}
+	close(release)
+	<-done
+	if !tracker.Idle(KindRequest) {
+		t.Error("request still tracked after the handlers returned")
+	}
+}
+
+func TestWorkTrackerRate(t *testing.T) {
+	clk := &stepClock{Clock: clock.Real, now: time.Unix(0, 0)}
+	tracker := NewWorkTracker()
+	tracker.SetClock(clk)
+	tracker.Begin(KindUpload, "a")
+
+	// The first report is the baseline, the idle time before it is not measured.
+	clk.now = clk.now.Add(time.Minute)
+	tracker.SetProgress(KindUpload, "a", 0, 1000)
+	if item := tracker.Snapshot()[0]; item.Rate != 0 || item.ETA != nil {
+		t.Fatalf("rate %v and ETA %v before any progress", item.Rate, item.ETA)
+	}
+
+	clk.now = clk.now.Add(time.Second)
+	tracker.SetProgress(KindUpload, "a", 100, 1000)
+	item := tracker.Snapshot()[0]
+	if item.Rate != 100 {
+		t.Fatalf("rate = %v, want 100", item.Rate)
+	}
+	if want := clk.now.Add(9 * time.Second); item.ETA == nil || !item.ETA.Equal(want) {
+		t.Fatalf("ETA = %v, want %v", item.ETA, want)
+	}
+
+	// A stall is measured once the progress moves again.
+	clk.now = clk.now.Add(time.Second)
+	tracker.SetProgress(KindUpload, "a", 100, 1000)
+	clk.now = clk.now.Add(time.Second)
+	tracker.SetProgress(KindUpload, "a", 200, 1000)
+	if rate := tracker.Snapshot()[0].Rate; rate != 100+rateWeight*(50-100) {
+		t.Fatalf("rate after a stall = %v", rate)
+	}
+
+	tracker.End(KindUpload, "a")
+	if rate := tracker.Rate(KindUpload); rate == 0 {
+		t.Error("the rate of the kind was forgotten with its items")
+	}
+}
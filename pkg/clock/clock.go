@@ -0,0 +1,105 @@
+// Package clock lets the drain timing be driven by a fake clock in the tests,
+// the production code uses Real.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the part of the time package the drain timing depends on.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is returned by AfterFunc, *time.Timer satisfies it.
+type Timer interface {
+	Stop() bool
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Or returns c, or Real when c is nil.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// WithTimeout is context.WithTimeout measured on c.
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if c == Real {
+		return context.WithTimeout(parent, d)
+	}
+	t := &timeoutContext{
+		parent:   parent,
+		deadline: c.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+	timer := c.AfterFunc(d, func() { t.cancel(context.DeadlineExceeded) })
+	go func() {
+		select {
+		case <-parent.Done():
+			t.cancel(parent.Err())
+		case <-t.done:
+		}
+	}()
+	return t, func() {
+		timer.Stop()
+		t.cancel(context.Canceled)
+	}
+}
+
+// timeoutContext has its own done channel so that the contexts derived from
+// it see its DeadlineExceeded rather than the error of an embedded context.
+type timeoutContext struct {
+	parent   context.Context
+	deadline time.Time
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (t *timeoutContext) cancel(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+		close(t.done)
+	}
+}
+
+func (t *timeoutContext) Deadline() (time.Time, bool) {
+	if parent, ok := t.parent.Deadline(); ok && parent.Before(t.deadline) {
+		return parent, true
+	}
+	return t.deadline, true
+}
+
+func (t *timeoutContext) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *timeoutContext) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *timeoutContext) Value(key interface{}) interface{} {
+	return t.parent.Value(key)
+}
@@ -0,0 +1,190 @@
+// Package drainctx provides the contexts handed to the long running work, an
+// HTTP handler or a Kafka message handler, so that it learns when the shutdown
+// starts and when the drain is about to be cut off. The work can then
+// checkpoint, shorten itself or abort cleanly instead of being killed mid-write.
+package drainctx
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/clock"
+)
+
+// Contexts holds the draining and the hard deadline contexts of a manager.
+type Contexts struct {
+	clock    clock.Clock
+	mu       sync.Mutex
+	draining context.Context
+	stop     context.CancelFunc
+	hard     *hardContext
+}
+
+// New reads the deadline of HardDeadline on clk, nil is the wall clock.
+func New(clk clock.Clock) *Contexts {
+	c := &Contexts{clock: clock.Or(clk)}
+	c.Reset()
+	return c
+}
+
+// Draining is done as soon as the drain starts, the work should finish
+// what it is doing and not start anything long anymore.
+func (c *Contexts) Draining() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// HardDeadline is done when the drain is cut off, by the drain timeout or by
+// Abort, the work must stop right away. Once the drain started with a
+// timeout, its Deadline reports when that happens at the latest.
+func (c *Contexts) HardDeadline() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hard
+}
+
+// StartDrain cancels Draining and, when timeout is positive, lets HardDeadline
+// expire timeout later on the clock. Calling it again during the same drain is a no-op.
+func (c *Contexts) StartDrain(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining.Err() != nil {
+		return
+	}
+	c.stop()
+	if timeout > 0 {
+		c.hard.expireAt(c.clock, c.clock.Now().Add(timeout))
+	}
+}
+
+// Abort cancels HardDeadline once the drain is cut off. Its Err is
+// context.DeadlineExceeded past the deadline, context.Canceled otherwise,
+// e.g. when the drain was forced.
+func (c *Contexts) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := context.Canceled
+	if deadline, ok := c.hard.Deadline(); ok && !c.clock.Now().Before(deadline) {
+		err = context.DeadlineExceeded
+	}
+	c.hard.cancel(err)
+}
+
+// Reset replaces the contexts once the manager receives again, the work
+// begun before keeps the contexts it was handed. Their hard deadline no
+// longer expires when the drain was canceled, the work goes on.
+func (c *Contexts) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining != nil && c.draining.Err() == nil {
+		return
+	}
+	if c.hard != nil {
+		c.hard.disarm()
+	}
+	c.draining, c.stop = context.WithCancel(context.Background())
+	c.hard = newHardContext()
+}
+
+// hardContext is a cancelable context whose deadline is only known once the
+// drain starts, after the work was handed the context. It has its own done
+// channel so that the contexts derived from it see its error.
+type hardContext struct {
+	done chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+	timer    clock.Timer
+	err      error
+}
+
+func newHardContext() *hardContext {
+	return &hardContext{done: make(chan struct{})}
+}
+
+func (h *hardContext) expireAt(clk clock.Clock, deadline time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deadline = deadline
+	h.timer = clk.AfterFunc(deadline.Sub(clk.Now()), func() {
+		h.cancel(context.DeadlineExceeded)
+	})
+}
+
+// disarm stops the timer of expireAt and forgets the deadline.
+func (h *hardContext) disarm() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	if h.err == nil {
+		h.deadline = time.Time{}
+	}
+}
+
+func (h *hardContext) cancel(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.err = err
+	close(h.done)
+}
+
+func (h *hardContext) Deadline() (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.deadline, !h.deadline.IsZero()
+}
+
+func (h *hardContext) Done() <-chan struct{} {
+	return h.done
+}
+
+func (h *hardContext) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+func (h *hardContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+type key struct{}
+
+// With returns a copy of ctx carrying c, see Draining and HardDeadline.
+func With(ctx context.Context, c *Contexts) context.Context {
+	return context.WithValue(ctx, key{}, contexts{c.Draining(), c.HardDeadline()})
+}
+
+type contexts struct {
+	draining context.Context
+	hard     context.Context
+}
+
+// Draining returns the draining context carried by ctx, a context which is
+// never done when ctx was not made by With.
+func Draining(ctx context.Context) context.Context {
+	if c, ok := ctx.Value(key{}).(contexts); ok {
+		return c.draining
+	}
+	return context.Background()
+}
+
+// HardDeadline returns the hard deadline context carried by ctx, ctx itself
+// when it was not made by With.
+func HardDeadline(ctx context.Context) context.Context {
+	if c, ok := ctx.Value(key{}).(contexts); ok {
+		return c.hard
+	}
+	return ctx
+}
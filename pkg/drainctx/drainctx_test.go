@@ -0,0 +1,62 @@
+package drainctx
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStartDrainExpiresHardDeadline(t *testing.T) {
+	c := New(nil)
+	ctx := With(context.Background(), c)
+	if Draining(ctx).Err() != nil || HardDeadline(ctx).Err() != nil {
+		t.Fatal("contexts done before the drain")
+	}
+
+	c.StartDrain(20 * time.Millisecond)
+	if Draining(ctx).Err() == nil {
+		t.Error("Draining not done once the drain started")
+	}
+	if _, ok := HardDeadline(ctx).Deadline(); !ok {
+		t.Error("HardDeadline has no deadline once the drain started")
+	}
+
+	select {
+	case <-HardDeadline(ctx).Done():
+	case <-time.After(time.Second):
+		t.Fatal("HardDeadline not done after the drain timeout")
+	}
+	if err := HardDeadline(ctx).Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HardDeadline.Err() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestAbortAndReset(t *testing.T) {
+	c := New(nil)
+	ctx := With(context.Background(), c)
+	c.StartDrain(0)
+	c.Abort()
+	if err := HardDeadline(ctx).Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("HardDeadline.Err() after Abort = %v, want %v", err, context.Canceled)
+	}
+
+	c.Reset()
+	if c.Draining().Err() != nil || c.HardDeadline().Err() != nil {
+		t.Error("contexts still done after Reset")
+	}
+	if HardDeadline(ctx).Err() == nil {
+		t.Error("Reset revived the contexts handed out before")
+	}
+}
+
+func TestWithoutContexts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if Draining(ctx).Err() != nil {
+		t.Error("Draining of a plain context is done")
+	}
+	if HardDeadline(ctx) != ctx {
+		t.Error("HardDeadline of a plain context is not the context itself")
+	}
+}
@@ -0,0 +1,125 @@
+// Package gracefultest runs the tus and the Kafka servers in-process with a
+// fake clock and a fake signal source, so that the shutdown scenarios are
+// tested without real signals and without sleeping for real seconds.
+package gracefultest
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/clock"
+)
+
+// waitTimeout bounds the real time the helpers wait for the servers.
+const waitTimeout = 5 * time.Second
+
+// Clock is a clock.Clock which only moves on Advance.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*timer
+	changed chan struct{}
+}
+
+type timer struct {
+	c  *Clock
+	at time.Time
+	f  func()
+}
+
+func NewClock() *Clock {
+	return &Clock{
+		now:     time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() { ch <- c.Now() })
+	return ch
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{c: c, at: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.timers = append(c.timers, t)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return t
+}
+
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, other := range t.c.timers {
+		if other == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock by d and runs the funcs of the timers which are due,
+// the earliest first.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].at.Before(c.timers[j].at)
+		})
+		if len(c.timers) == 0 || c.timers[0].at.After(c.now) {
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.mu.Unlock()
+		t.f()
+	}
+}
+
+// Timers returns the number of pending timers.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// WaitTimers blocks until at least n timers are pending, i.e. until the code
+// under test is waiting on the clock.
+func (c *Clock) WaitTimers(t testing.TB, n int) {
+	t.Helper()
+	deadline := time.After(waitTimeout)
+	for {
+		c.mu.Lock()
+		pending, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("gracefultest: %d timers pending, want %d", pending, n)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package gracefultest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/davidtrse/graceful/kafkas"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/davidtrse/graceful/pkg/drainctx"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka is an in-memory kafkas.IKafkaManager, the messages passed to Send are
+// read in order and the written ones are kept in Written.
+type Kafka struct {
+	tracker  kafkas.Tracker
+	ctxs     *drainctx.Contexts
+	timeout  time.Duration
+	messages chan kafka.Message
+
+	mu      sync.Mutex
+	closed  chan struct{}
+	pending []kafka.Message
+	written []kafka.Message
+}
+
+// NewKafka records the transcodes with tracker, the hard deadline of the
+// message handlers expires drainTimeout after Close as measured on clk.
+func NewKafka(tracker kafkas.Tracker, clk clock.Clock, drainTimeout time.Duration) *Kafka {
+	return &Kafka{
+		tracker:  tracker,
+		ctxs:     drainctx.New(clk),
+		timeout:  drainTimeout,
+		messages: make(chan kafka.Message, 64),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Send makes value the next message read.
+func (k *Kafka) Send(value string) {
+	k.messages <- kafka.Message{Topic: "topic-test", Key: []byte(value), Value: []byte(value)}
+}
+
+// Written returns the messages written so far.
+func (k *Kafka) Written() []kafka.Message {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]kafka.Message(nil), k.written...)
+}
+
+func (k *Kafka) CreateReader() {}
+func (k *Kafka) CreateWriter() {}
+
+func (k *Kafka) ReadMessage(topic string) (kafka.Message, error) {
+	k.mu.Lock()
+	closed := k.closed
+	select {
+	case <-closed:
+		k.mu.Unlock()
+		return kafka.Message{}, kafkas.ErrContextClosed
+	default:
+	}
+	if len(k.pending) > 0 {
+		msg := k.pending[0]
+		k.pending = k.pending[1:]
+		k.mu.Unlock()
+		return msg, nil
+	}
+	k.mu.Unlock()
+
+	select {
+	case msg := <-k.messages:
+		return msg, nil
+	case <-closed:
+		return kafka.Message{}, kafkas.ErrContextClosed
+	}
+}
+
+func (k *Kafka) Requeue(msg kafka.Message) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pending = append(k.pending, msg)
+}
+
+func (k *Kafka) WriteMessage(topic string, key []byte, value []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.written = append(k.written, kafka.Message{Topic: topic, Key: key, Value: value})
+	return nil
+}
+
+func (k *Kafka) WriteMessageWithHeader(topic string, key []byte, value []byte, headerName string, headerValue string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	h := kafka.Header{Key: headerName, Value: []byte(headerValue)}
+	k.written = append(k.written, kafka.Message{Topic: topic, Key: key, Value: value, Headers: []kafka.Header{h}})
+	return nil
+}
+
+func (k *Kafka) StartNewTranscode(id string) { k.tracker.Begin(kafkas.TranscodeKind, id) }
+func (k *Kafka) DoneTranscode(id string)     { k.tracker.End(kafkas.TranscodeKind, id) }
+func (k *Kafka) IsDone() bool                { return k.tracker.Idle(kafkas.TranscodeKind) }
+func (k *Kafka) RunningTranscodes() []string { return k.tracker.IDs(kafkas.TranscodeKind) }
+
+func (k *Kafka) Wait(ctx context.Context) error {
+	return k.tracker.Wait(ctx, kafkas.TranscodeKind)
+}
+
+func (k *Kafka) Draining() context.Context     { return k.ctxs.Draining() }
+func (k *Kafka) HardDeadline() context.Context { return k.ctxs.HardDeadline() }
+func (k *Kafka) Abort()                        { k.ctxs.Abort() }
+
+func (k *Kafka) MessageContext(ctx context.Context) context.Context {
+	return drainctx.With(ctx, k.ctxs)
+}
+
+func (k *Kafka) Close() {
+	k.ctxs.StartDrain(k.timeout)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	select {
+	case <-k.closed:
+	default:
+		close(k.closed)
+	}
+}
+
+func (k *Kafka) Resume() {
+	k.ctxs.Reset()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	select {
+	case <-k.closed:
+		k.closed = make(chan struct{})
+	default:
+	}
+}
+
+func (k *Kafka) StopReadMessage()  {}
+func (k *Kafka) StopWriteMessage() {}
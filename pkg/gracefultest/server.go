@@ -0,0 +1,305 @@
+package gracefultest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/server"
+	"github.com/davidtrse/graceful/tus"
+)
+
+// result is what a server run returned.
+type result struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the server returned.
+func (r *result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Exited reports whether the server returned.
+func (r *result) Exited() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits for the server to return and returns its error.
+func (r *result) Wait(t testing.TB) error {
+	t.Helper()
+	select {
+	case <-r.done:
+		return r.err
+	case <-time.After(waitTimeout):
+		t.Fatal("gracefultest: the server did not exit")
+	}
+	return nil
+}
+
+// stop shuts the server down at the end of the test, forcing the drain
+// when work is still running.
+func (r *result) stop(t testing.TB, cancel context.CancelFunc, signals *Signals) {
+	cancel()
+	deadline := time.After(waitTimeout)
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+			signals.deliver(syscall.SIGTERM)
+		case <-deadline:
+			t.Fatal("gracefultest: the server did not exit")
+		}
+	}
+}
+
+// TUS is a tus server run in-process by StartTUS.
+type TUS struct {
+	result
+	URL     string
+	Clock   *Clock
+	Signals *Signals
+	Manager app.GracefulTUSManager
+	Client  *http.Client
+}
+
+// StartTUS runs a tus.Server on an httptest listener, with its uploads
+// in a temporary directory, and returns once it serves. configure changes
+// the config before the server starts.
+func StartTUS(t testing.TB, configure ...func(*tus.Config)) *TUS {
+	t.Helper()
+	ln := httptest.NewUnstartedServer(http.NotFoundHandler()).Listener
+	s := &TUS{
+		result:  result{done: make(chan struct{})},
+		URL:     "http://" + ln.Addr().String(),
+		Clock:   NewClock(),
+		Signals: NewSignals(),
+		Client:  &http.Client{Timeout: waitTimeout},
+	}
+
+	// The config does not start from tus.DefaultConfig, the GRACEFUL_*
+	// variables of the environment must not change the tests. The pressure
+	// limits, the janitor, the journal and the admin API are enabled by the
+	// tests needing them.
+	cfg := tus.Config{
+		Addr:             ln.Addr().String(),
+		Listener:         ln,
+		Dir:              t.TempDir(),
+		StaleUploadAfter: 2 * time.Minute,
+		Rejection: app.RejectionConfig{
+			RetryAfter:  5 * time.Second,
+			PeerHeader:  "X-Upload-Peer",
+			SetLocation: true,
+		},
+		Clock:        s.Clock,
+		SignalSource: s.Signals,
+	}
+	for _, f := range configure {
+		f(&cfg)
+	}
+
+	appCtx := tus.NewContext(cfg)
+	s.Manager = appCtx.GracefulTUSManager
+	srv, err := tus.New(appCtx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(s.done)
+		s.err = srv.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		s.Client.CloseIdleConnections()
+		s.stop(t, cancel, s.Signals)
+	})
+
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		res, err := s.Client.Get(s.URL + app.ReadyzPath)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if s.Exited() || time.Now().After(deadline) {
+			t.Fatalf("gracefultest: the tus server is not ready, err=%v", s.err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return s
+}
+
+// Wait closes the idle connections of Client, which the server would wait for
+// when they never sent a request, then waits for the server to return.
+func (s *TUS) Wait(t testing.TB) error {
+	t.Helper()
+	s.Client.CloseIdleConnections()
+	return s.result.Wait(t)
+}
+
+// Shutdown sends SIGTERM and waits until the drain started.
+func (s *TUS) Shutdown(t testing.TB) {
+	t.Helper()
+	s.Signals.Send(t, syscall.SIGTERM)
+	deadline := time.After(waitTimeout)
+	for s.Manager.DrainStartedAt().IsZero() {
+		select {
+		case <-deadline:
+			t.Fatal("gracefultest: the drain did not start")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// Do sends a tus request to path with the given headers.
+func (s *TUS) Do(t testing.TB, method, path string, header map[string]string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// CreateUpload creates an upload of length bytes and returns its path once
+// the manager tracks it, the server records the creation after the 201.
+func (s *TUS) CreateUpload(t testing.TB, length int) string {
+	t.Helper()
+	res := s.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Length": strconv.Itoa(length)}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("gracefultest: POST /files = %d", res.StatusCode)
+	}
+	loc, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := path.Base(loc.Path)
+	deadline := time.After(waitTimeout)
+	for !s.running(id) {
+		select {
+		case <-deadline:
+			t.Fatalf("gracefultest: upload %s is not tracked", id)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return loc.Path
+}
+
+func (s *TUS) running(id string) bool {
+	for _, running := range s.Manager.RunningUploads() {
+		if running == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Patch sends data at offset to the upload at path and returns the status code.
+func (s *TUS) Patch(t testing.TB, path string, offset int, data []byte) int {
+	t.Helper()
+	return s.Do(t, http.MethodPatch, path, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, data).StatusCode
+}
+
+// KafkaServer is a Kafka server run in-process by StartKafka against Kafka.
+type KafkaServer struct {
+	result
+	Kafka   *Kafka
+	Tracker *app.WorkTracker
+	Events  *app.EventBus
+	Clock   *Clock
+	Signals *Signals
+}
+
+// StartKafka runs a server.KafkaServer against an in-memory Kafka and
+// returns once it waits for the signals. configure changes the config
+// before the server starts.
+func StartKafka(t testing.TB, configure ...func(*server.KafkaServerConfig)) *KafkaServer {
+	t.Helper()
+	s := &KafkaServer{
+		result:  result{done: make(chan struct{})},
+		Tracker: app.NewWorkTracker(),
+		Clock:   NewClock(),
+		Signals: NewSignals(),
+	}
+
+	// Like StartTUS, the config ignores the GRACEFUL_* variables.
+	cfg := server.KafkaServerConfig{
+		Clock:        s.Clock,
+		SignalSource: s.Signals,
+	}
+	// Resume sends SIGCONT, which the default policy does not map.
+	cfg.Signals, _ = app.ParseSignalPolicy(app.DefaultSignalPolicy(), "CONT=resume")
+	for _, f := range configure {
+		f(&cfg)
+	}
+	s.Kafka = NewKafka(s.Tracker, s.Clock, cfg.DrainTimeout)
+	s.Tracker.SetClock(s.Clock)
+	s.Events = app.NewEventBus(s.Clock)
+	s.Tracker.SetEvents(s.Events, app.KindTranscode)
+	srv, err := server.NewKafkaServer(&app.Context{KafkaManager: s.Kafka, Tracker: s.Tracker, Events: s.Events}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(s.done)
+		s.err = srv.Run(ctx)
+	}()
+	t.Cleanup(func() { s.stop(t, cancel, s.Signals) })
+
+	s.Signals.waitNotified(t)
+	return s
+}
+
+// Shutdown sends SIGTERM and waits until the drain started.
+func (s *KafkaServer) Shutdown(t testing.TB) {
+	t.Helper()
+	s.Signals.Send(t, syscall.SIGTERM)
+	select {
+	case <-s.Kafka.Draining().Done():
+	case <-time.After(waitTimeout):
+		t.Fatal("gracefultest: the drain did not start")
+	}
+}
+
+// Resume sends SIGCONT and waits until the drain was canceled.
+func (s *KafkaServer) Resume(t testing.TB) {
+	t.Helper()
+	s.Signals.Send(t, syscall.SIGCONT)
+	deadline := time.After(waitTimeout)
+	for s.Kafka.Draining().Err() != nil {
+		select {
+		case <-deadline:
+			t.Fatal("gracefultest: the drain was not canceled")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package gracefultest
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Signals is an app.SignalSource delivering the signals passed to Send.
+type Signals struct {
+	mu      sync.Mutex
+	subs    map[chan<- os.Signal][]os.Signal
+	changed chan struct{}
+}
+
+func NewSignals() *Signals {
+	return &Signals{
+		subs:    map[chan<- os.Signal][]os.Signal{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *Signals) Notify(c chan<- os.Signal, sig ...os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[c] = append(s.subs[c], sig...)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Signals) Stop(c chan<- os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, c)
+}
+
+// Send waits until a channel is notified of sig and delivers sig to it.
+// Unlike the os/signal package it does not drop the signal when nobody reads it yet.
+func (s *Signals) Send(t testing.TB, sig os.Signal) {
+	t.Helper()
+	deadline := time.After(waitTimeout)
+	for {
+		s.mu.Lock()
+		var targets []chan<- os.Signal
+		for c, sigs := range s.subs {
+			for _, want := range sigs {
+				if want == sig {
+					targets = append(targets, c)
+				}
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(targets) > 0 {
+			for _, c := range targets {
+				select {
+				case c <- sig:
+				case <-deadline:
+					t.Fatalf("gracefultest: %s not read", sig)
+				}
+			}
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("gracefultest: nobody is notified of %s", sig)
+		}
+	}
+}
+
+// waitNotified blocks until a channel is notified of any signal.
+func (s *Signals) waitNotified(t testing.TB) {
+	t.Helper()
+	deadline := time.After(waitTimeout)
+	for {
+		s.mu.Lock()
+		n, changed := len(s.subs), s.changed
+		s.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatal("gracefultest: nobody is notified of the signals")
+		}
+	}
+}
+
+// deliver sends sig to the channels notified of it which are ready to read it.
+func (s *Signals) deliver(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, sigs := range s.subs {
+		for _, want := range sigs {
+			if want == sig {
+				select {
+				case c <- sig:
+				default:
+				}
+			}
+		}
+	}
+}
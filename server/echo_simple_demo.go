@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/davidtrse/graceful/pkg/app"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 )
@@ -21,7 +22,7 @@ func Simple() {
 	// Use a buffered channel to avoid missing signals as recommended for signal.Notify
 	isOSExist := make(chan os.Signal, 1)
 	// go func(isOSExist chan os.Signal) {
-	signal.Notify(isOSExist, os.Interrupt)
+	signal.Notify(isOSExist, app.DefaultSignalPolicy().Signals(app.SignalDrain, app.SignalStop)...)
 	// }(isOSExist)
 
 	// Setup
@@ -6,101 +6,290 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/davidtrse/graceful/kafkas"
 	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/davidtrse/graceful/pkg/drainctx"
 	"github.com/labstack/gommon/log"
+	"github.com/segmentio/kafka-go"
 )
 
-func Kafka() {
+const (
+	drainTimeoutEnv = "GRACEFUL_DRAIN_TIMEOUT"
+	// journalEnv is the path of the journal of the transcodes, unset disables it.
+	journalEnv = "GRACEFUL_KAFKA_JOURNAL"
+	// signalsEnv overrides the actions of the signals, see app.ParseSignalPolicy.
+	signalsEnv = "GRACEFUL_SIGNALS"
+	// webhooksEnv lists the URLs the lifecycle events are posted to,
+	// signed with webhookSecretEnv.
+	webhooksEnv      = "GRACEFUL_WEBHOOKS"
+	webhookSecretEnv = "GRACEFUL_WEBHOOK_SECRET"
+	// webhookFlushEnv bounds the delivery of the events left after the drain.
+	webhookFlushEnv = "GRACEFUL_WEBHOOK_FLUSH_TIMEOUT"
+	// coordinatorEnv is the URI of the drain coordinator shared by the
+	// nodes, e.g. file:///shared/drain or postgres://..., coordinatorSlotsEnv
+	// the number of nodes draining at once.
+	coordinatorEnv      = "GRACEFUL_DRAIN_COORDINATOR"
+	coordinatorSlotsEnv = "GRACEFUL_DRAIN_SLOTS"
+)
 
-	InitKafka()
-	go mainLoop()
+// KafkaServerConfig is what the Kafka server runs with, the tests replace
+// parts of DefaultKafkaConfig.
+type KafkaServerConfig struct {
+	DrainTimeout time.Duration
+	// JournalPath enables the journal of the transcodes when not empty.
+	JournalPath  string
+	Signals      app.SignalPolicy
+	Clock        clock.Clock
+	SignalSource app.SignalSource
+	// Webhooks receive the lifecycle events when it has URLs.
+	Webhooks app.WebhookConfig
+	// Coordinator limits the nodes draining at once, nil drains right away.
+	Coordinator app.DrainCoordinator
+}
 
-	// catch the signal
-	existOSsignal := make(chan os.Signal, 1)
-	signal.Notify(existOSsignal, syscall.SIGINT, syscall.SIGTERM)
+// DefaultKafkaConfig reads the GRACEFUL_* environment variables.
+func DefaultKafkaConfig() KafkaServerConfig {
+	return KafkaServerConfig{
+		DrainTimeout: app.EnvDuration(drainTimeoutEnv, 0),
+		JournalPath:  os.Getenv(journalEnv),
+		Signals:      app.EnvSignalPolicy(signalsEnv),
+		Clock:        clock.Real,
+		SignalSource: app.OSSignals{},
+		Webhooks: app.WebhookConfig{
+			URLs:   app.EnvList(webhooksEnv),
+			Secret: os.Getenv(webhookSecretEnv),
+			// The events left after the drain are posted within it at most.
+			FlushTimeout: app.EnvDuration(webhookFlushEnv, 10*time.Second),
+		},
+		Coordinator: app.EnvDrainCoordinator(coordinatorEnv, coordinatorSlotsEnv),
+	}
+}
 
-	wait := make(chan bool, 1)
-d:
-	for {
-		select {
-		case <-existOSsignal:
-			wait <- true
-			fmt.Println("shutting down...")
-			app.Instance.KafkaManager.Close()
-			app.Instance.KafkaManager.StopReadMessage()
-		case <-wait:
-			if app.Instance.KafkaManager.IsDone() {
-				break d
-			} else {
-				wait <- true
-			}
-		}
-		time.Sleep(1 * time.Second)
+func Kafka() error {
+	return KafkaWithConfig(context.Background(), DefaultKafkaConfig())
+}
+
+// KafkaWithConfig consumes until a signal of cfg.SignalSource arrives or ctx
+// is done and returns once the shutdown is over.
+func KafkaWithConfig(ctx context.Context, cfg KafkaServerConfig) error {
+	srv, err := NewKafkaServer(NewKafkaContext(cfg), cfg)
+	if err != nil {
+		return err
+	}
+	if err := srv.Run(ctx); err != nil {
+		log.Errorf("Server exited with error, err=%s", err)
+		return err
 	}
 
-	app.Instance.KafkaManager.StopWriteMessage()
 	fmt.Println("Server exited.")
+	return nil
 }
 
-func InitKafka() {
+// NewKafkaContext creates the tracker and the Kafka manager connected to the
+// brokers a KafkaServer runs with.
+func NewKafkaContext(cfg KafkaServerConfig) *app.Context {
+	tracker := app.NewWorkTracker()
+	tracker.SetClock(cfg.Clock)
+	events := app.NewEventBus(cfg.Clock)
+	tracker.SetEvents(events, app.KindTranscode)
 	km, err := kafkas.NewKafkaManager(&kafkas.KafkaConfig{
 		Hosts:   "127.0.0.1:9092",
 		GroupId: "vodtrans",
 		Topics:  "topic-test",
-	})
+	}, tracker)
 
-	km.Context = context.Background()
 	if err != nil {
 		log.Fatalf("Failed to create Kafka manager: %s", err.Error())
 	}
+	km.DrainTimeout = cfg.DrainTimeout
+	km.SetClock(cfg.Clock)
 
 	km.CreateReader()
-	app.Instance = &app.Context{
+	return &app.Context{
 		KafkaManager: km,
+		Tracker:      tracker,
+		Events:       events,
+	}
+}
+
+// KafkaServer consumes the transcodes with a graceful shutdown. Run consumes
+// until a signal, embedders call Start and Shutdown instead.
+type KafkaServer struct {
+	appCtx *app.Context
+	lc     *app.Lifecycle
+}
+
+// NewKafkaServer builds a KafkaServer on the manager and the tracker of
+// appCtx, the tracker must be the one the manager records the transcodes
+// with. When cfg.JournalPath is set it requeues the transcodes interrupted
+// by the previous process.
+func NewKafkaServer(appCtx *app.Context, cfg KafkaServerConfig) (*KafkaServer, error) {
+	km := appCtx.KafkaManager
+	lc := app.NewLifecycle()
+	lc.DrainTimeout = cfg.DrainTimeout
+	lc.Clock = cfg.Clock
+	lc.SignalSource = cfg.SignalSource
+	if cfg.Signals != nil {
+		lc.Signals = cfg.Signals
+	}
+	lc.Events = appCtx.Events
+	lc.Coordinator = cfg.Coordinator
+	lc.Append(app.KafkaHooks(km)...)
+	var webhooks *app.Webhooks
+	if len(cfg.Webhooks.URLs) > 0 {
+		webhooks = app.NewWebhooks(appCtx.Events, cfg.Webhooks)
+	}
+	lc.Append(app.EventHooks(appCtx.Events, webhooks)...)
+	if cfg.JournalPath != "" {
+		journal, err := app.OpenJournal(cfg.JournalPath, app.KindTranscode)
+		if err != nil {
+			return nil, err
+		}
+		journal.SetClock(cfg.Clock)
+		appCtx.Tracker.SetJournal(journal)
+		journal.OnRecovered(func() {
+			for _, item := range journal.Interrupted(app.KindTranscode) {
+				log.Infof("Transcode %s was interrupted at %s, requeued", item.ID, item.StartedAt)
+				km.Requeue(kafka.Message{Value: []byte(item.ID)})
+			}
+		})
+		lc.Append(app.JournalHooks(journal)...)
+	}
+	c := &consumer{km: km, clk: clock.Or(cfg.Clock)}
+	lc.Append(app.Hook{
+		Name:      "kafka.consumer",
+		DependsOn: []string{"kafka.admission"},
+		OnStart: func(ctx context.Context) error {
+			c.start()
+			return nil
+		},
+		OnResume: func(ctx context.Context) error {
+			c.start()
+			return nil
+		},
+	})
+	return &KafkaServer{appCtx: appCtx, lc: lc}, nil
+}
+
+// Context returns the manager and the tracker the server runs with.
+func (s *KafkaServer) Context() *app.Context {
+	return s.appCtx
+}
+
+// Run starts consuming, waits for a signal of cfg.SignalSource or for ctx to
+// be done and returns once the shutdown is over.
+func (s *KafkaServer) Run(ctx context.Context) error {
+	return s.lc.Run(ctx)
+}
+
+// Start returns once the consumer reads the messages.
+func (s *KafkaServer) Start(ctx context.Context) error {
+	return s.lc.Start(ctx)
+}
+
+// Shutdown stops reading, waits for the running transcodes within
+// cfg.DrainTimeout and closes the consumer.
+func (s *KafkaServer) Shutdown(ctx context.Context) error {
+	return s.lc.Stop(ctx)
+}
+
+// consumer runs mainLoop once at a time. The loop ends when km is closed and
+// is started again when the drain is canceled.
+type consumer struct {
+	km  kafkas.IKafkaManager
+	clk clock.Clock
+
+	mu      sync.Mutex
+	running bool
+}
+
+func (c *consumer) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		c.running = true
+		go c.run()
+	}
+}
+
+func (c *consumer) run() {
+	for {
+		err := mainLoop(c.km, c.clk)
+		c.mu.Lock()
+		// km was resumed before the loop saw it closed, read on.
+		if errors.Is(err, kafkas.ErrContextClosed) && c.km.Draining().Err() == nil {
+			c.mu.Unlock()
+			continue
+		}
+		c.running = false
+		c.mu.Unlock()
+		return
 	}
 }
 
-func mainLoop() {
+// mainLoop transcodes the messages until the reading stops and returns why.
+func mainLoop(km kafkas.IKafkaManager, clk clock.Clock) error {
 	for {
-		msg, err := app.Instance.KafkaManager.ReadMessage("")
+		msg, err := km.ReadMessage("")
 		if err != nil {
 			if err == io.EOF {
 				fmt.Println("Read message error. Reader is closed")
-				break
+				return err
 			}
 
 			if errors.Is(err, kafkas.ErrContextClosed) {
 				fmt.Println("Context done! Reader is closed")
-				break
+				return err
 			}
 
 			log.Error("Failed on reading msg")
 			continue
 		}
-		app.Instance.KafkaManager.StartNewTranscode(string(msg.Value))
-		// if receive message is "Slow", will sleep 30 second while loop and print 0-29
-		if string(msg.Value) == "Slow" {
-			fmt.Println("Slow.....")
-
-			for i := 0; i < 30; i++ {
-				fmt.Printf("Slow: %d\n", i)
-				time.Sleep(1 * time.Second)
-			}
-		} else {
-			fmt.Printf("Message: msg=%s \n", string(msg.Value))
-			for i := 0; i < 2; i++ {
-				fmt.Printf("Fast: %d\n", i)
-				time.Sleep(1 * time.Second)
-			}
-			if kafkas.IsNotEmpty(msg) {
-				fmt.Println("msg not empty..")
-			}
+		km.StartNewTranscode(string(msg.Value))
+		ctx := km.MessageContext(context.Background())
+		if err := transcode(ctx, clk, msg); err != nil {
+			log.Errorf("Transcode %s aborted, err=%s", string(msg.Value), err)
+		}
+		km.DoneTranscode(string(msg.Value))
+	}
+}
+
+// transcode handles one message. It checkpoints once the drain starts and
+// aborts when the drain is cut off instead of being killed mid-write.
+func transcode(ctx context.Context, clk clock.Clock, msg kafka.Message) error {
+	steps := 2
+	// if receive message is "Slow", will sleep 30 second while loop and print 0-29
+	if string(msg.Value) == "Slow" {
+		fmt.Println("Slow.....")
+		steps = 30
+	} else {
+		fmt.Printf("Message: msg=%s \n", string(msg.Value))
+	}
+
+	draining := drainctx.Draining(ctx).Done()
+	var step <-chan time.Time
+	for i := 0; i < steps; {
+		if step == nil {
+			step = clk.After(1 * time.Second)
 		}
-		app.Instance.KafkaManager.DoneTranscode(string(msg.Value))
+		select {
+		case <-draining:
+			fmt.Printf("Draining: checkpoint at step %d\n", i)
+			draining = nil
+		case <-drainctx.HardDeadline(ctx).Done():
+			return fmt.Errorf("stopped at step %d: %w", i, drainctx.HardDeadline(ctx).Err())
+		case <-step:
+			fmt.Printf("Step: %d\n", i)
+			step = nil
+			i++
+		}
+	}
+	if kafkas.IsNotEmpty(msg) {
+		fmt.Println("msg not empty..")
 	}
+	return nil
 }
@@ -0,0 +1,118 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/pkg/gracefultest"
+	"github.com/davidtrse/graceful/server"
+)
+
+func TestShutdownWaitsForTranscodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		message      string
+		drainTimeout time.Duration
+		// advance moves the fake clock once the drain started, each time
+		// after timers are pending.
+		advance  []time.Duration
+		timers   int
+		wantCode int
+	}{
+		{
+			name:     "exits after the transcode completes",
+			message:  "job",
+			advance:  []time.Duration{time.Second, time.Second},
+			timers:   1,
+			wantCode: app.ExitClean,
+		},
+		{
+			name:         "drain timeout aborts the transcode",
+			message:      "Slow",
+			drainTimeout: 5 * time.Second,
+			advance:      []time.Duration{5 * time.Second},
+			// The step, the drain timer and the hard deadline.
+			timers:   3,
+			wantCode: app.ExitForced,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := gracefultest.StartKafka(t, func(cfg *server.KafkaServerConfig) {
+				cfg.DrainTimeout = tt.drainTimeout
+			})
+			s.Kafka.Send(tt.message)
+			// The transcode waits for its first step.
+			s.Clock.WaitTimers(t, 1)
+
+			s.Shutdown(t)
+			if s.Exited() {
+				t.Fatal("the server exited while the transcode is running")
+			}
+			for _, d := range tt.advance {
+				s.Clock.WaitTimers(t, tt.timers)
+				s.Clock.Advance(d)
+			}
+			if code := app.ExitCode(s.Wait(t)); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if ids := s.Tracker.IDs(app.KindTranscode); tt.wantCode == app.ExitClean && len(ids) != 0 {
+				t.Errorf("transcodes still running: %v", ids)
+			}
+		})
+	}
+}
+
+func TestResumeSignalReadsAgain(t *testing.T) {
+	s := gracefultest.StartKafka(t)
+	// The running transcode keeps the server draining.
+	s.Kafka.Send("first")
+	s.Clock.WaitTimers(t, 1)
+	s.Shutdown(t)
+	s.Resume(t)
+
+	s.Kafka.Send("second")
+	for i := 0; i < 4; i++ {
+		s.Clock.WaitTimers(t, 1)
+		s.Clock.Advance(time.Second)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Tracker.Wait(ctx, app.KindTranscode); err != nil {
+		t.Fatalf("transcodes still running: %v", s.Tracker.IDs(app.KindTranscode))
+	}
+	if s.Exited() {
+		t.Fatal("the server exited after the drain was canceled")
+	}
+
+	s.Shutdown(t)
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code = %d, want %d", code, app.ExitClean)
+	}
+}
+
+func TestResumeDisarmsHardDeadline(t *testing.T) {
+	s := gracefultest.StartKafka(t, func(cfg *server.KafkaServerConfig) {
+		cfg.DrainTimeout = 5 * time.Second
+	})
+	s.Kafka.Send("job")
+	s.Clock.WaitTimers(t, 1)
+	// The context the running transcode was handed before the drain.
+	hard := s.Kafka.HardDeadline()
+
+	s.Shutdown(t)
+	// The step, the drain timer and the hard deadline.
+	s.Clock.WaitTimers(t, 3)
+	s.Resume(t)
+	s.Clock.Advance(6 * time.Second)
+	if err := hard.Err(); err != nil {
+		t.Errorf("HardDeadline().Err() past the timeout of the canceled drain = %v, want nil", err)
+	}
+	if _, ok := hard.Deadline(); ok {
+		t.Error("HardDeadline() keeps the deadline of the canceled drain")
+	}
+}
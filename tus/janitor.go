@@ -0,0 +1,206 @@
+package tus
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidtrse/graceful/log"
+	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/pkg/clock"
+	"github.com/labstack/echo/v4"
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// expiresHeader tells the clients until when an upload can be resumed.
+const expiresHeader = "Upload-Expires"
+
+// janitor removes the uploads of the file store which were not completed
+// within ttl of their creation. The uploads running in this process and the
+// locked ones are never removed, nor is anything while parentRunning reports
+// that the process upgraded from still serves its own uploads.
+type janitor struct {
+	store    filestore.FileStore
+	locker   tusd.Locker
+	m        app.GracefulTUSManager
+	ttl      time.Duration
+	interval time.Duration
+	clock    clock.Clock
+	// parentRunning is set by New once the upgrader exists.
+	parentRunning func() bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newJanitor(cfg Config, locker tusd.Locker, m app.GracefulTUSManager) *janitor {
+	interval := cfg.JanitorInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &janitor{
+		store:    filestore.New(cfg.Dir),
+		locker:   locker,
+		m:        m,
+		ttl:      cfg.UploadTTL,
+		interval: interval,
+		clock:    clock.Or(cfg.Clock),
+
+		parentRunning: func() bool { return false },
+	}
+}
+
+// expiresAt returns when the upload id expires, false when it does not: it
+// is complete, but for a partial upload, or unknown. The creation time is
+// the one of its .info file.
+func (j *janitor) expiresAt(ctx context.Context, id string) (time.Time, bool) {
+	if id == "" {
+		return time.Time{}, false
+	}
+	upload, err := j.store.GetUpload(ctx, id)
+	if err != nil {
+		return time.Time{}, false
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil || !info.IsPartial && !info.SizeIsDeferred && info.Offset == info.Size {
+		return time.Time{}, false
+	}
+	st, err := os.Stat(filepath.Join(j.store.Path, id+".info"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return st.ModTime().Add(j.ttl), true
+}
+
+// sweep removes the expired uploads and returns how many. After an upgrade
+// the parent may still be PATCHing an upload this process does not track,
+// the sweeps wait for it to exit.
+func (j *janitor) sweep(ctx context.Context) int {
+	if j.parentRunning() {
+		log.Infof("janitor: the parent process still drains, sweep skipped")
+		return 0
+	}
+	entries, err := os.ReadDir(j.store.Path)
+	if err != nil {
+		log.Errorf("janitor: read %s, err=%s", j.store.Path, err)
+		return 0
+	}
+	removed := 0
+	now := j.clock.Now()
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".info")
+		if id == entry.Name() {
+			continue
+		}
+		expires, ok := j.expiresAt(ctx, id)
+		if !ok || now.Before(expires) {
+			continue
+		}
+		if j.remove(ctx, id, expires) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// remove terminates the upload id unless a request holds its lock or it is
+// running, a stale upload may still be resumed by its client.
+func (j *janitor) remove(ctx context.Context, id string, expires time.Time) bool {
+	lock, err := j.locker.NewLock(id)
+	if err != nil {
+		log.Errorf("janitor: lock upload %s, err=%s", id, err)
+		return false
+	}
+	if err := lock.Lock(); err != nil {
+		return false
+	}
+	defer lock.Unlock()
+	for _, running := range j.m.RunningUploads() {
+		if running == id {
+			return false
+		}
+	}
+
+	upload, err := j.store.GetUpload(ctx, id)
+	if err == nil {
+		err = j.store.AsTerminatableUpload(upload).Terminate(ctx)
+	}
+	if err != nil {
+		log.Errorf("janitor: remove upload %s, err=%s", id, err)
+		return false
+	}
+	log.Infof("janitor: removed upload %s, expired at %s", id, expires.Format(time.RFC3339))
+	j.m.Metrics().Expired()
+	// An upload interrupted by a previous process is resolved in the journal.
+	j.m.DoneUpload(id)
+	return true
+}
+
+func (j *janitor) start() {
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	go func() {
+		defer close(j.done)
+		for {
+			tick := make(chan struct{})
+			timer := j.clock.AfterFunc(j.interval, func() { close(tick) })
+			select {
+			case <-tick:
+				j.sweep(context.Background())
+			case <-j.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// hooks sweep on startup and every interval until the drain begins, a
+// canceled drain starts them again.
+func (j *janitor) hooks() []app.Hook {
+	return []app.Hook{
+		{
+			Name:  "tus.janitor",
+			Phase: app.PhaseStopAdmission,
+			OnStart: func(ctx context.Context) error {
+				if n := j.sweep(ctx); n > 0 {
+					log.Infof("janitor: removed %d expired uploads on startup", n)
+				}
+				j.start()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				close(j.stop)
+				<-j.done
+				return nil
+			},
+			OnResume: func(ctx context.Context) error {
+				j.start()
+				return nil
+			},
+		},
+	}
+}
+
+// advertise answers the requests on the incomplete uploads with their
+// expiration in expiresHeader.
+func (j *janitor) advertise(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		res := c.Response()
+		res.Before(func() {
+			id := c.Param("fileID")
+			if location := res.Header().Get(echo.HeaderLocation); id == "" && location != "" {
+				id = path.Base(location)
+			}
+			if expires, ok := j.expiresAt(c.Request().Context(), id); ok {
+				res.Header().Set(expiresHeader, expires.UTC().Format(http.TimeFormat))
+			}
+		})
+		return next(c)
+	}
+}
@@ -0,0 +1,79 @@
+package tus
+
+import (
+	"fmt"
+
+	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/tus/tusd/pkg/filelocker"
+	tusd "github.com/tus/tusd/pkg/handler"
+	"github.com/tus/tusd/pkg/memorylocker"
+)
+
+// Lockers of the uploads, a request PATCHing an upload holds its lock so
+// that two clients can't interleave their writes.
+const (
+	LockerMemory = "memory"
+	LockerFile   = "file"
+)
+
+// LockerConfig selects how the uploads are locked.
+type LockerConfig struct {
+	// Backend is LockerMemory, the default, which locks within the
+	// process, or LockerFile, which locks with files in Dir and works
+	// across the nodes sharing Dir.
+	Backend string
+	// Dir defaults to Config.Dir.
+	Dir string
+}
+
+// newLocker returns the locker of cfg reporting the held locks to m.
+func newLocker(cfg Config, m app.GracefulTUSManager) (tusd.Locker, error) {
+	var locker tusd.Locker
+	switch cfg.Locker.Backend {
+	case "", LockerMemory:
+		locker = memorylocker.New()
+	case LockerFile:
+		dir := cfg.Locker.Dir
+		if dir == "" {
+			dir = cfg.Dir
+		}
+		locker = filelocker.New(dir)
+	default:
+		return nil, fmt.Errorf("unknown locker %q, want %s or %s", cfg.Locker.Backend, LockerMemory, LockerFile)
+	}
+	return trackedLocker{locker: locker, m: m}, nil
+}
+
+// trackedLocker tells the manager which uploads are locked, the drain waits
+// for the locks to be released.
+type trackedLocker struct {
+	locker tusd.Locker
+	m      app.GracefulTUSManager
+}
+
+func (l trackedLocker) NewLock(id string) (tusd.Lock, error) {
+	lock, err := l.locker.NewLock(id)
+	if err != nil {
+		return nil, err
+	}
+	return trackedLock{lock: lock, id: id, m: l.m}, nil
+}
+
+type trackedLock struct {
+	lock tusd.Lock
+	id   string
+	m    app.GracefulTUSManager
+}
+
+func (l trackedLock) Lock() error {
+	if err := l.lock.Lock(); err != nil {
+		return err
+	}
+	l.m.LockUpload(l.id)
+	return nil
+}
+
+func (l trackedLock) Unlock() error {
+	defer l.m.UnlockUpload(l.id)
+	return l.lock.Unlock()
+}
@@ -0,0 +1,74 @@
+package tus
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+	"github.com/tus/tusd/pkg/s3store"
+)
+
+// Backends of the uploads.
+const (
+	StoreFile = "file"
+	StoreS3   = "s3"
+)
+
+// StoreConfig selects where the uploads are stored, the manager tracks them
+// the same way whatever the backend.
+type StoreConfig struct {
+	// Backend is StoreFile, the default, which keeps the uploads in
+	// Config.Dir, or StoreS3.
+	Backend string
+	// Bucket and ObjectPrefix locate the uploads of StoreS3, Endpoint
+	// points at an S3-compatible server such as MinIO. The credentials
+	// are read from the AWS environment variables.
+	Bucket       string
+	ObjectPrefix string
+	Endpoint     string
+	Region       string
+}
+
+// newComposer plugs the backend of cfg into a new composer.
+func newComposer(cfg Config) (*tusd.StoreComposer, error) {
+	composer := tusd.NewStoreComposer()
+	switch cfg.Store.Backend {
+	case "", StoreFile:
+		filestore.FileStore{Path: cfg.Dir}.UseIn(composer)
+	case StoreS3:
+		store, err := newS3Store(cfg.Store)
+		if err != nil {
+			return nil, err
+		}
+		store.UseIn(composer)
+	default:
+		return nil, fmt.Errorf("unknown store %q, want %s or %s", cfg.Store.Backend, StoreFile, StoreS3)
+	}
+	return composer, nil
+}
+
+func newS3Store(cfg StoreConfig) (s3store.S3Store, error) {
+	if cfg.Bucket == "" {
+		return s3store.S3Store{}, fmt.Errorf("the %s store needs a bucket", StoreS3)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	awsCfg := aws.NewConfig().WithRegion(region)
+	if cfg.Endpoint != "" {
+		// MinIO and the other S3-compatible servers don't serve the
+		// buckets as sub-domains.
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return s3store.S3Store{}, err
+	}
+	store := s3store.New(cfg.Bucket, s3.New(sess))
+	store.ObjectPrefix = cfg.ObjectPrefix
+	return store, nil
+}
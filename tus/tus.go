@@ -2,22 +2,23 @@ package tus
 
 import (
 	"context"
-	"errors"
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"strings"
 	"time"
 
 	"github.com/davidtrse/graceful/log"
 	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/pkg/clock"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	_ "github.com/lib/pq"
-	"github.com/tus/tusd/pkg/filestore"
 	tusd "github.com/tus/tusd/pkg/handler"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -36,151 +37,499 @@ import (
 const (
 	dirPath = "./upload"
 	dirName = "tusSave"
+
+	drainTimeoutEnv = "GRACEFUL_DRAIN_TIMEOUT"
+	staleUploadEnv  = "GRACEFUL_STALE_UPLOAD_AFTER"
+	retryAfterEnv   = "GRACEFUL_RETRY_AFTER"
+	peersEnv        = "GRACEFUL_PEERS"
+	// journalEnv is the path of the journal of the uploads, e.g. ./upload.journal,
+	// unset disables it.
+	journalEnv = "GRACEFUL_JOURNAL"
+	// signalsEnv overrides the actions of the signals, see app.ParseSignalPolicy.
+	signalsEnv = "GRACEFUL_SIGNALS"
+	// webhooksEnv lists the URLs the lifecycle events are posted to,
+	// signed with webhookSecretEnv.
+	webhooksEnv      = "GRACEFUL_WEBHOOKS"
+	webhookSecretEnv = "GRACEFUL_WEBHOOK_SECRET"
+	// webhookFlushEnv bounds the delivery of the events left after the drain.
+	webhookFlushEnv = "GRACEFUL_WEBHOOK_FLUSH_TIMEOUT"
+	// coordinatorEnv is the URI of the drain coordinator shared by the
+	// nodes, e.g. file:///shared/drain or postgres://..., coordinatorSlotsEnv
+	// the number of nodes draining at once.
+	coordinatorEnv      = "GRACEFUL_DRAIN_COORDINATOR"
+	coordinatorSlotsEnv = "GRACEFUL_DRAIN_SLOTS"
+	// storeEnv selects the backend of the uploads, file or s3. The s3
+	// store reads the credentials from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY.
+	storeEnv      = "GRACEFUL_STORE"
+	s3BucketEnv   = "GRACEFUL_S3_BUCKET"
+	s3PrefixEnv   = "GRACEFUL_S3_PREFIX"
+	s3EndpointEnv = "GRACEFUL_S3_ENDPOINT"
+	s3RegionEnv   = "GRACEFUL_S3_REGION"
+	// lockerEnv selects how the uploads are locked, memory or file, the
+	// file locks are kept in lockDirEnv which defaults to the upload dir.
+	lockerEnv  = "GRACEFUL_LOCKER"
+	lockDirEnv = "GRACEFUL_LOCK_DIR"
+	// terminationSecretEnv signs the tokens allowing the clients to
+	// terminate their uploads, the nodes behind a load balancer share it.
+	// Unset, a random secret is drawn and the tokens don't outlive the process.
+	terminationSecretEnv = "GRACEFUL_TERMINATION_SECRET"
+	// adminTokenEnv is the bearer token of the admin API, unset disables it.
+	adminTokenEnv = "GRACEFUL_ADMIN_TOKEN"
+	// The thresholds past which the new uploads are shed, zero disables
+	// the limit. The sizes are in bytes.
+	diskMarginEnv    = "GRACEFUL_DISK_MARGIN"
+	maxUploadsEnv    = "GRACEFUL_MAX_UPLOADS"
+	maxHeapEnv       = "GRACEFUL_MAX_HEAP"
+	maxGoroutinesEnv = "GRACEFUL_MAX_GOROUTINES"
+	// fitDrainWindowEnv refuses the uploads too large to complete within
+	// the drain timeout at the measured rate.
+	fitDrainWindowEnv = "GRACEFUL_FIT_DRAIN_WINDOW"
+
+	// uploadTTLEnv is the time an upload has to complete before the
+	// janitor removes it, every janitorIntervalEnv. Unset or zero keeps
+	// them, the janitor is opt-in so that a first deploy removes nothing.
+	uploadTTLEnv       = "GRACEFUL_UPLOAD_TTL"
+	janitorIntervalEnv = "GRACEFUL_JANITOR_INTERVAL"
+
+	// peerHeader tells the rejected clients which node to retry on.
+	peerHeader = "X-Upload-Peer"
 )
 
 var (
 	tracer = otel.Tracer("tus")
 )
 
-func Run() {
-	Init()
-	shutdown := configureStdout(context.Background())
-	defer shutdown()
+// Config is what the server runs with, the tests replace parts of DefaultConfig.
+type Config struct {
+	// Addr is bound unless Listener is set.
+	Addr     string
+	Listener net.Listener
+	// Dir holds the uploads of the file store and must exist before the
+	// server starts.
+	Dir              string
+	DrainTimeout     time.Duration
+	StaleUploadAfter time.Duration
+	Rejection        app.RejectionConfig
+	// UploadTTL expires the uploads of the file store not completed
+	// within it, the janitor removes them every JanitorInterval. Zero
+	// disables the janitor.
+	UploadTTL       time.Duration
+	JanitorInterval time.Duration
+	// Pressure sheds the new uploads, its Dir defaults to Dir with the
+	// file store.
+	Pressure app.PressureConfig
+	// Store selects the backend of the uploads.
+	Store StoreConfig
+	// Locker selects how the uploads are locked.
+	Locker LockerConfig
+	// JournalPath enables the journal of the uploads when not empty.
+	JournalPath string
+	// AdminToken enables the admin API and the event stream and guards them
+	// and the drain cancelation when not empty.
+	AdminToken string
+	// TerminationSecret signs the tokens of the uploads, see
+	// app.TerminationToken, empty draws a random one.
+	TerminationSecret string
+	// Signals maps the signals to their action, nil is the default policy.
+	Signals app.SignalPolicy
+	// Webhooks receive the lifecycle events when it has URLs.
+	Webhooks app.WebhookConfig
+	// Coordinator limits the nodes draining at once, nil drains right away.
+	Coordinator app.DrainCoordinator
+	// Telemetry exports the traces, off in the tests.
+	Telemetry    bool
+	Clock        clock.Clock
+	SignalSource app.SignalSource
+}
+
+// DefaultConfig reads the GRACEFUL_* environment variables.
+func DefaultConfig() Config {
+	return Config{
+		Addr:             ":8180",
+		Dir:              dirPath,
+		DrainTimeout:     app.EnvDuration(drainTimeoutEnv, 0),
+		StaleUploadAfter: app.EnvDuration(staleUploadEnv, 2*time.Minute),
+		UploadTTL:        app.EnvDuration(uploadTTLEnv, 0),
+		JanitorInterval:  app.EnvDuration(janitorIntervalEnv, time.Hour),
+		Rejection: app.RejectionConfig{
+			RetryAfter:  app.EnvDuration(retryAfterEnv, 5*time.Second),
+			Peers:       app.EnvList(peersEnv),
+			PeerHeader:  peerHeader,
+			SetLocation: true,
+		},
+		Pressure: app.PressureConfig{
+			DiskMargin:     app.EnvInt(diskMarginEnv, 100<<20),
+			MaxUploads:     int(app.EnvInt(maxUploadsEnv, 0)),
+			MaxHeapBytes:   uint64(app.EnvInt(maxHeapEnv, 0)),
+			MaxGoroutines:  int(app.EnvInt(maxGoroutinesEnv, 0)),
+			FitDrainWindow: app.EnvBool(fitDrainWindowEnv, false),
+		},
+		Store: StoreConfig{
+			Backend:      os.Getenv(storeEnv),
+			Bucket:       os.Getenv(s3BucketEnv),
+			ObjectPrefix: os.Getenv(s3PrefixEnv),
+			Endpoint:     os.Getenv(s3EndpointEnv),
+			Region:       os.Getenv(s3RegionEnv),
+		},
+		Locker: LockerConfig{
+			Backend: os.Getenv(lockerEnv),
+			Dir:     os.Getenv(lockDirEnv),
+		},
+		JournalPath:  os.Getenv(journalEnv),
+		AdminToken:   os.Getenv(adminTokenEnv),
+		Telemetry:    true,
+		Signals:      app.EnvSignalPolicy(signalsEnv),
+		Clock:        clock.Real,
+		SignalSource: app.OSSignals{},
+		Webhooks: app.WebhookConfig{
+			URLs:   app.EnvList(webhooksEnv),
+			Secret: os.Getenv(webhookSecretEnv),
+			// The events left after the drain are posted within it at most.
+			FlushTimeout: app.EnvDuration(webhookFlushEnv, 10*time.Second),
+		},
+		Coordinator:       app.EnvDrainCoordinator(coordinatorEnv, coordinatorSlotsEnv),
+		TerminationSecret: os.Getenv(terminationSecretEnv),
+	}
+}
+
+func Run() error {
+	return RunWithConfig(context.Background(), DefaultConfig())
+}
+
+// RunWithConfig serves until a signal of cfg.SignalSource arrives or ctx is
+// done and returns once the shutdown is over.
+func RunWithConfig(ctx context.Context, cfg Config) error {
+	srv, err := New(NewContext(cfg), cfg)
+	if err != nil {
+		return err
+	}
 	log.Println("TUS Server started")
-	// Create a new FileStore instance which is responsible for
-	// storing the uploaded file on disk in the specified directory.
-	// This path _must_ exist before tusd will store uploads in it.
-	// If you want to save them on a different medium, for example
-	// a remote FTP server, you can implement your own storage backend
-	// by implementing the tusd.DataStore interface.
-	store := filestore.FileStore{
-		Path: dirPath,
+	if err := srv.Run(ctx); err != nil {
+		log.Errorf("Server exited with error, err=%s", err)
+		return err
+	}
+	fmt.Println("===> Server exited graceful.")
+	return nil
+}
+
+// NewContext creates the tracker and the upload manager a Server runs with.
+func NewContext(cfg Config) *app.Context {
+	tracker := app.NewWorkTracker()
+	tracker.SetClock(cfg.Clock)
+	events := app.NewEventBus(cfg.Clock)
+	tracker.SetEvents(events, app.KindUpload)
+	// The uploads of the s3 store leave the disk, only an explicit
+	// Pressure.Dir is checked.
+	if cfg.Pressure.Dir == "" && (cfg.Store.Backend == "" || cfg.Store.Backend == StoreFile) {
+		cfg.Pressure.Dir = cfg.Dir
 	}
+	return &app.Context{
+		GracefulTUSManager: app.NewShutdownManage(
+			app.WithTracker(tracker),
+			app.WithClock(cfg.Clock),
+			app.WithStaleAfter(cfg.StaleUploadAfter),
+			app.WithDrainTimeout(cfg.DrainTimeout),
+			app.WithRejection(cfg.Rejection),
+			app.WithPressure(cfg.Pressure),
+		),
+		Tracker: tracker,
+		Events:  events,
+	}
+}
 
+// Server is a tus server with its graceful shutdown. Run serves until a
+// signal, embedders call Start and Shutdown instead.
+type Server struct {
+	appCtx *app.Context
+	lc     *app.Lifecycle
+}
+
+// New builds a Server on the manager and the tracker of appCtx.
+func New(appCtx *app.Context, cfg Config) (*Server, error) {
+	m := appCtx.GracefulTUSManager
+	shutdownTracer := func(context.Context) error { return nil }
+	if cfg.Telemetry {
+		shutdownTracer = configureStdout(context.Background())
+	}
 	// A storage backend for tusd may consist of multiple different parts which
 	// handle upload creation, locking, termination and so on. The composer is a
-	// place where all those separated pieces are joined together. In this example
-	// we only use the file store but you may plug in multiple.
-	composer := tusd.NewStoreComposer()
-	store.UseIn(composer)
+	// place where all those separated pieces are joined together. cfg.Store
+	// selects the file store, on the local disk under cfg.Dir, or the s3 store.
+	composer, err := newComposer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// The requests on an upload hold its lock, the drain waits for the
+	// locks to be released as well as for the uploads to complete.
+	locker, err := newLocker(cfg, m)
+	if err != nil {
+		return nil, err
+	}
+	composer.UseLocker(locker)
 
 	// Create a new HTTP handler for the tusd server by providing a configuration.
 	// The StoreComposer property must be set to allow the handler to function.
 	handler, err := tusd.NewHandler(tusd.Config{
-		BasePath:              "/files/",
-		StoreComposer:         composer,
-		NotifyCompleteUploads: true,
-		NotifyCreatedUploads:  true,
+		BasePath:                "/files/",
+		StoreComposer:           composer,
+		NotifyCompleteUploads:   true,
+		NotifyCreatedUploads:    true,
+		NotifyTerminatedUploads: true,
+		NotifyUploadProgress:    true,
 		PreUploadCreateCallback: func(hook tusd.HookEvent) error {
-			fmt.Println("PreUploadCreateCallback")
-			fmt.Println("PreUploadCreateCallback:  IsAcceptingRequestStopped ====>", app.Instance.GracefulTUSManager.IsReceivingRequest())
-			if !app.Instance.GracefulTUSManager.IsReceivingRequest() {
-				return tusd.NewHTTPError(errors.New("server not available"), http.StatusServiceUnavailable)
+			size := hook.Upload.Size
+			if hook.Upload.SizeIsDeferred {
+				size = -1
+			}
+			// A final upload only concatenates the parts received so far, it
+			// is admitted during the drain with its parts.
+			if hook.Upload.IsFinal {
+				if rej := m.AdmitFinalUpload(hook.HTTPRequest.RemoteAddr, hook.HTTPRequest.URI, hook.Upload.PartialUploads); rej != nil {
+					return rejectionError{*rej}
+				}
+				return nil
+			}
+			if rej := m.AdmitUpload(hook.HTTPRequest.RemoteAddr, hook.HTTPRequest.URI, size); rej != nil {
+				return rejectionError{*rej}
 			}
-			return nil
-		},
-		PreFinishResponseCallback: func(hook tusd.HookEvent) error {
-			fmt.Println("Pre-finish create handler success")
-
 			return nil
 		},
 	})
 	if err != nil {
-		panic(fmt.Errorf("Unable to create handler: %s", err))
+		return nil, fmt.Errorf("Unable to create handler: %s", err)
 	}
 
-	/// Start another goroutine for receiving events from the handler whenever
-	// an upload is created.
-	go func() {
-		for {
-			event := <-handler.CreatedUploads
-			fmt.Printf("Upload %s created\n", event.Upload.ID)
-			app.Instance.GracefulTUSManager.StartNewUpload(event.Upload.ID)
-		}
-	}()
-
-	// Start another goroutine for receiving events from the handler whenever
-	// an upload is completed. The event will contains details about the upload
-	// itself and the relevant HTTP request.
-	go func() {
-		for {
-			event := <-handler.CompleteUploads
-			fmt.Printf("Upload %s finished\n", event.Upload.ID)
-			app.Instance.GracefulTUSManager.DoneUpload(event.Upload.ID)
-		}
-	}()
-
 	e := echo.New()
-	app.Instance.GracefulTUSManager.StartReceivingRequest()
-	e.Use(app.Instance.GracefulTUSManager.EchoMiddleware())
-
+	// CORS comes first so that the browsers can read the rejections of the drain.
 	cors := middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		MaxAge:       3600,
+		AllowOrigins:  []string{"*"},
+		MaxAge:        3600,
+		ExposeHeaders: []string{"Retry-After", peerHeader, echo.HeaderLocation, app.TerminationTokenHeader, expiresHeader},
 	})
 	e.Use(cors)
-
-	e.POST("/files", echo.WrapHandler(http.HandlerFunc(handler.PostFile)), echo.WrapMiddleware(tusmiddleware))
-	e.HEAD("/files/:fileID", echo.WrapHandler(http.HandlerFunc(handler.HeadFile)), echo.WrapMiddleware(tusmiddleware))
-	e.PATCH("/files/:fileID", echo.WrapHandler(http.HandlerFunc(handler.PatchFile)), echo.WrapMiddleware(tusmiddleware))
+	e.Use(m.EchoMiddleware())
+	// The tus routes are tracked as uploads, the other requests as plain HTTP requests.
+	e.Use(appCtx.Tracker.EchoMiddleware(func(c echo.Context) bool {
+		return strings.HasPrefix(c.Path(), "/files") || app.IsProbePath(c.Path()) || c.Path() == app.MetricsPath ||
+			app.IsLifecyclePath(c.Path()) || app.IsAdminPath(c.Path()) || c.Path() == app.EventsPath
+	}))
+
+	// The creation answers the token the client terminates its upload with,
+	// the admin may terminate any upload.
+	secret := cfg.TerminationSecret
+	if secret == "" {
+		secret = randomSecret()
+	}
+	// The incomplete uploads of the file store expire after cfg.UploadTTL,
+	// the clients are told when in Upload-Expires.
+	tusRoute := []echo.MiddlewareFunc{echo.WrapMiddleware(tusmiddleware)}
+	var expiration *janitor
+	switch {
+	case cfg.UploadTTL <= 0:
+	case cfg.Store.Backend == "" || cfg.Store.Backend == StoreFile:
+		expiration = newJanitor(cfg, locker, m)
+		tusRoute = append(tusRoute, expiration.advertise)
+	default:
+		log.Infof("The %s store does not expire the uploads, set a lifecycle rule on the bucket", cfg.Store.Backend)
+	}
+	e.POST("/files", echo.WrapHandler(http.HandlerFunc(handler.PostFile)), append(tusRoute, app.IssueTerminationTokens(secret))...)
+	e.HEAD("/files/:fileID", echo.WrapHandler(http.HandlerFunc(handler.HeadFile)), tusRoute...)
+	e.PATCH("/files/:fileID", echo.WrapHandler(http.HandlerFunc(handler.PatchFile)), tusRoute...)
 	e.GET("/files/:fileID", echo.WrapHandler(http.HandlerFunc(handler.GetFile)))
+	e.DELETE("/files/:fileID", echo.WrapHandler(http.HandlerFunc(handler.DelFile)), echo.WrapMiddleware(tusmiddleware), app.TerminationAuth(secret, cfg.AdminToken))
+	app.RegisterHealthHandlers(e, appCtx)
+	app.RegisterMetricsHandler(e, appCtx)
+	// The uploads interrupted by the previous process are listed until they
+	// complete, are terminated or are resolved by hand.
+	// The admin token guards everything changing the server over HTTP and the
+	// event stream, which are not served without it.
+	var auth echo.MiddlewareFunc
+	if cfg.AdminToken != "" {
+		auth = app.AdminAuth(cfg.AdminToken)
+	}
+	var journal *app.Journal
+	if cfg.JournalPath != "" {
+		if journal, err = app.OpenJournal(cfg.JournalPath, app.KindUpload); err != nil {
+			return nil, err
+		}
+		journal.SetClock(cfg.Clock)
+		appCtx.Tracker.SetJournal(journal)
+		// After an upgrade the journal is recovered once the parent exited.
+		journal.OnRecovered(func() {
+			for _, item := range journal.Interrupted(app.KindUpload) {
+				log.Infof("Upload %s was interrupted, started at %s", item.ID, item.StartedAt)
+			}
+		})
+		app.RegisterJournalHandlers(e, journal, auth)
+	}
 	e.GET("/", hello)
 	e.GET("/l", helloSlow)
-	// Start server in dedicated go routine
-	go func() {
-		if err := e.Start(":8180"); err != nil {
-			if err != nil && err != http.ErrServerClosed {
-				e.Logger.Errorf("shutting down the server..., err=%s", err)
-			} else {
-				e.Logger.Info("Server terminated...")
-			}
-		}
-	}()
 
 	// GRACEFUL SHUTDOWN
-	// Wait for interrupt signal to gracefully shutdown the server.
-	// Use a buffered channel to avoid missing signals as recommended for signal.Notify
-	isOSExist := make(chan os.Signal, 1)
-	signal.Notify(
-		isOSExist,
-		syscall.SIGHUP,  // kill - SIGHUP XXXX
-		syscall.SIGINT,  // kill - SIGIN XXXX or Ctrl + C
-		syscall.SIGQUIT, // kill - SIGQUICT XXXX
-	)
-	isOk := make(chan bool, 1)
-d:
+	// The lifecycle serves until SIGTERM or SIGINT arrives, then stops
+	// admitting requests, waits for the running uploads and shuts the server down.
+	// The wait is bounded by GRACEFUL_DRAIN_TIMEOUT, a second signal cuts it short.
+	// GRACEFUL_SIGNALS maps the signals to other actions.
+	// SIGUSR2 hands the listener over to a new build of the binary first.
+	upgrader, err := app.NewUpgrader()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Listener != nil {
+		upgrader.SetListener(cfg.Listener)
+	}
+	lc := app.NewLifecycle()
+	lc.DrainTimeout = cfg.DrainTimeout
+	lc.Upgrader = upgrader
+	if expiration != nil {
+		expiration.parentRunning = upgrader.ParentRunning
+	}
+	lc.Clock = cfg.Clock
+	lc.SignalSource = cfg.SignalSource
+	if cfg.Signals != nil {
+		lc.Signals = cfg.Signals
+	}
+	lc.Events = appCtx.Events
+	lc.Coordinator = cfg.Coordinator
+	lc.Append(app.TelemetryHooks(shutdownTracer)...)
+	// The events are logged and posted to the webhooks until the telemetry is flushed.
+	var webhooks *app.Webhooks
+	if len(cfg.Webhooks.URLs) > 0 {
+		webhooks = app.NewWebhooks(appCtx.Events, cfg.Webhooks)
+	}
+	lc.Append(app.EventHooks(appCtx.Events, webhooks)...)
+	if journal != nil {
+		lc.Append(app.JournalHooks(journal)...)
+	}
+	lc.Append(app.TUSHooks(m)...)
+	// The notifications are received until the HTTP server is shut down, the
+	// requests served meanwhile still record their uploads.
+	stopNotifications := make(chan struct{})
+	lc.Append(app.Hook{
+		Name:  "tus.notifications",
+		Phase: app.PhaseFlushProducers,
+		OnStart: func(ctx context.Context) error {
+			go receiveUploadEvents(handler, m, stopNotifications)
+			go receiveUploadProgress(handler, m, stopNotifications)
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			close(stopNotifications)
+			return nil
+		},
+	})
+	if expiration != nil {
+		lc.Append(expiration.hooks()...)
+	}
+	lc.Append(app.RequestHooks(appCtx.Tracker)...)
+	lc.Append(app.EchoHooks(e, cfg.Addr, upgrader)...)
+	// Under a Type=notify systemd unit, report the readiness, the stop and the uploads in flight.
+	lc.Append(app.SystemdHooks(app.NewNotifier(), m)...)
+	// With an admin token, POST /lifecycle/resume, like the signal mapped to resume,
+	// cancels a drain started by mistake and /admin/maintenance stops admitting
+	// uploads without exiting.
+	app.RegisterLifecycleHandlers(e, lc, auth)
+	app.RegisterEventsHandler(e, appCtx.Events, auth)
+	if auth != nil {
+		app.RegisterAdminHandlers(e, m, auth)
+	}
+	return &Server{appCtx: appCtx, lc: lc}, nil
+}
+
+// receiveUploadEvents receives the events of the handler whenever an upload
+// is created, completed or terminated until stop is closed. The events will
+// contain details about the upload itself and the relevant HTTP request.
+// They are received by one goroutine so that they are recorded in order, a
+// final upload completes right after its creation.
+func receiveUploadEvents(handler *tusd.Handler, m app.GracefulTUSManager, stop <-chan struct{}) {
 	for {
 		select {
-		case <-isOSExist:
-			isOk <- true
-			fmt.Println("====> Graceful shutting down...")
-			app.Instance.GracefulTUSManager.StopReceivingRequest()
-		case <-isOk:
-			if app.Instance.GracefulTUSManager.CanShutdown() {
-				fmt.Println("====> GracefulTUSManager.IsDone=true...")
-				break d
+		case event := <-handler.CreatedUploads:
+			fmt.Printf("Upload %s created\n", event.Upload.ID)
+			if event.Upload.IsFinal {
+				m.StartFinalUpload(event.Upload.ID, event.Upload.PartialUploads)
+			} else {
+				m.StartNewUpload(event.Upload.ID)
+			}
+		case event := <-handler.CompleteUploads:
+			fmt.Printf("Upload %s finished\n", event.Upload.ID)
+			// A partial upload keeps the drain waiting for its final upload.
+			if event.Upload.IsPartial {
+				m.AwaitFinalUpload(event.Upload.ID)
 			} else {
-				isOk <- true
-				fmt.Println("====> Graceful shutting down...")
-				time.Sleep(1 * time.Second)
+				m.DoneUpload(event.Upload.ID)
 			}
+		case event := <-handler.TerminatedUploads:
+			// A terminated upload does not block the shutdown anymore.
+			fmt.Printf("Upload %s terminated\n", event.Upload.ID)
+			m.DoneUpload(event.Upload.ID)
+		case <-stop:
+			return
 		}
 	}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
-	} else {
-		fmt.Println("===> Server exited graceful.")
+// receiveUploadProgress receives the progress of the running PATCH requests
+// until stop is closed, uploads without progress turn stale after
+// GRACEFUL_STALE_UPLOAD_AFTER.
+func receiveUploadProgress(handler *tusd.Handler, m app.GracefulTUSManager, stop <-chan struct{}) {
+	for {
+		select {
+		case event := <-handler.UploadProgress:
+			m.SetUploadProgress(event.Upload.ID, event.Upload.Offset, event.Upload.Size)
+		case <-stop:
+			return
+		}
 	}
 }
 
-func Init() {
-	app.Instance = &app.Context{
-		GracefulTUSManager: app.NewShutdownManage(),
+// Context returns the manager and the tracker the server runs with.
+func (s *Server) Context() *app.Context {
+	return s.appCtx
+}
+
+// Run starts the server, waits for a signal of cfg.SignalSource or for ctx
+// to be done and returns once the shutdown is over.
+func (s *Server) Run(ctx context.Context) error {
+	return s.lc.Run(ctx)
+}
+
+// Start returns once the server accepts connections.
+func (s *Server) Start(ctx context.Context) error {
+	return s.lc.Start(ctx)
+}
+
+// Shutdown stops admitting uploads, waits for the running ones within
+// cfg.DrainTimeout and stops the server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.lc.Stop(ctx)
+}
+
+// rejectionError carries the JSON rejection body through the tusd error handling.
+type rejectionError struct {
+	rej app.Rejection
+}
+
+func (e rejectionError) Error() string {
+	return e.rej.Message
+}
+
+func (e rejectionError) StatusCode() int {
+	return e.rej.Status
+}
+
+func (e rejectionError) Body() []byte {
+	return e.rej.Body()
+}
+
+// randomSecret draws the termination secret of a process.
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
 	}
+	return hex.EncodeToString(b)
 }
 
 func hello(c echo.Context) error {
@@ -208,15 +557,21 @@ func hello(c echo.Context) error {
 	return nil
 }
 
-func helloSlow(echo echo.Context) error {
+// helloSlow answers after 15 seconds, or right away once the drain starts.
+func helloSlow(c echo.Context) error {
 	s1 := rand.NewSource(time.Now().UnixNano())
 	r1 := rand.New(s1)
 
 	for i := 0; i < 15; i++ {
 		fmt.Println(i)
-		time.Sleep(1 * time.Second)
+		select {
+		case <-app.Draining(c).Done():
+			fmt.Printf("Draining: answer early at %d\n", i)
+			return c.String(http.StatusOK, strconv.Itoa(r1.Intn(100)))
+		case <-time.After(1 * time.Second):
+		}
 	}
-	echo.Response().Write([]byte(strconv.Itoa(r1.Intn(100))))
+	c.Response().Write([]byte(strconv.Itoa(r1.Intn(100))))
 	return nil
 }
 
@@ -235,16 +590,16 @@ func tusmiddleware(h http.Handler) http.Handler {
 			header.Set("Access-Control-Allow-Origin", origin)
 
 			if r.Method == "OPTIONS" {
-				allowedMethods := "POST, HEAD, PATCH, OPTIONS"
+				allowedMethods := "POST, HEAD, PATCH, DELETE, OPTIONS"
 
 				// Preflight request
 				header.Add("Access-Control-Allow-Methods", allowedMethods)
-				header.Add("Access-Control-Allow-Headers", "Authorization, Origin, X-Requested-With, X-Request-ID, X-HTTP-Method-Override, Content-Type, Upload-Length, Upload-Offset, Tus-Resumable, Upload-Metadata, Upload-Defer-Length, Upload-Concat")
+				header.Add("Access-Control-Allow-Headers", "Authorization, Origin, X-Requested-With, X-Request-ID, X-HTTP-Method-Override, Content-Type, Upload-Length, Upload-Offset, Tus-Resumable, Upload-Metadata, Upload-Defer-Length, Upload-Concat, "+app.TerminationTokenHeader)
 				header.Set("Access-Control-Max-Age", "86400")
 
 			} else {
 				// Actual request
-				header.Add("Access-Control-Expose-Headers", "Upload-Offset, Location, Upload-Length, Tus-Version, Tus-Resumable, Tus-Max-Size, Tus-Extension, Upload-Metadata, Upload-Defer-Length, Upload-Concat")
+				header.Add("Access-Control-Expose-Headers", "Upload-Offset, Location, Upload-Length, Tus-Version, Tus-Resumable, Tus-Max-Size, Tus-Extension, Upload-Metadata, Upload-Defer-Length, Upload-Concat, Retry-After, "+peerHeader+", "+app.TerminationTokenHeader+", "+expiresHeader)
 			}
 		}
 
@@ -272,7 +627,7 @@ func tusmiddleware(h http.Handler) http.Handler {
 	})
 }
 
-func configureStdout(ctx context.Context) func() {
+func configureStdout(ctx context.Context) func(context.Context) error {
 	configGrpcInsecure := false
 	secureOption := otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, ""))
 	if configGrpcInsecure {
@@ -306,9 +661,5 @@ func configureStdout(ctx context.Context) func() {
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 	otel.SetTracerProvider(provider)
 
-	return func() {
-		if err := provider.Shutdown(ctx); err != nil {
-			panic(err)
-		}
-	}
+	return provider.Shutdown
 }
@@ -0,0 +1,609 @@
+package tus_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davidtrse/graceful/pkg/app"
+	"github.com/davidtrse/graceful/pkg/gracefultest"
+	"github.com/davidtrse/graceful/tus"
+	"github.com/labstack/echo/v4"
+)
+
+func TestShutdownWaitsForUploads(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		// finish sends the rest of the upload during the drain, otherwise
+		// the fake clock is moved past the drain timeout.
+		finish   bool
+		wantCode int
+	}{
+		{name: "exits after the upload completes", finish: true, wantCode: app.ExitClean},
+		{name: "drain timeout abandons the upload", drainTimeout: 30 * time.Second, wantCode: app.ExitForced},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+				cfg.DrainTimeout = tt.drainTimeout
+			})
+			upload := s.CreateUpload(t, 10)
+			if code := s.Patch(t, upload, 0, []byte("01234")); code != http.StatusNoContent {
+				t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+			}
+
+			s.Shutdown(t)
+			// A request round trip lets the server go on with the shutdown.
+			s.Do(t, http.MethodHead, upload, nil, nil)
+			if s.Exited() {
+				t.Fatal("the server exited while the upload is running")
+			}
+
+			if tt.finish {
+				if code := s.Patch(t, upload, 5, []byte("56789")); code != http.StatusNoContent {
+					t.Fatalf("PATCH during the drain = %d, want %d", code, http.StatusNoContent)
+				}
+			} else {
+				// The drain timer, the hard deadline and the stale window
+				// of the upload.
+				s.Clock.WaitTimers(t, 3)
+				s.Clock.Advance(tt.drainTimeout)
+			}
+			if code := app.ExitCode(s.Wait(t)); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRequestsDuringDrain(t *testing.T) {
+	s := gracefultest.StartTUS(t)
+	upload := s.CreateUpload(t, 10)
+	s.Shutdown(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{name: "new upload", method: http.MethodPost, path: "/files", want: http.StatusServiceUnavailable},
+		{name: "running upload", method: http.MethodHead, path: upload, want: http.StatusOK},
+		{name: "unknown upload", method: http.MethodPatch, path: "/files/unknown", want: http.StatusServiceUnavailable},
+		{name: "plain request", method: http.MethodGet, path: "/", want: http.StatusServiceUnavailable},
+		{name: "liveness", method: http.MethodGet, path: app.HealthzPath, want: http.StatusOK},
+		{name: "readiness", method: http.MethodGet, path: app.ReadyzPath, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := s.Do(t, tt.method, tt.path, map[string]string{"Upload-Length": "10"}, nil)
+			if res.StatusCode != tt.want {
+				t.Fatalf("%s %s = %d, want %d", tt.method, tt.path, res.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusServiceUnavailable || tt.path == app.ReadyzPath {
+				return
+			}
+			if res.Header.Get("Retry-After") == "" {
+				t.Error("rejection without Retry-After")
+			}
+			var rej app.Rejection
+			if err := json.NewDecoder(res.Body).Decode(&rej); err != nil || rej.Error != "draining" {
+				t.Errorf("rejection body = %+v, err=%v", rej, err)
+			}
+		})
+	}
+}
+
+func TestServersSideBySide(t *testing.T) {
+	start := func(t *testing.T) (*tus.Server, string) {
+		ln := httptest.NewUnstartedServer(http.NotFoundHandler()).Listener
+		cfg := tus.DefaultConfig()
+		cfg.Listener = ln
+		cfg.Dir = t.TempDir()
+		cfg.JournalPath = ""
+		cfg.Telemetry = false
+		cfg.Clock = gracefultest.NewClock()
+		srv, err := tus.New(tus.NewContext(cfg), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return srv, "http://" + ln.Addr().String()
+	}
+	first, _ := start(t)
+	second, url := start(t)
+	defer second.Shutdown(context.Background())
+
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if first.Context().GracefulTUSManager.IsReceivingRequest() {
+		t.Error("the first server still admits uploads")
+	}
+	if !second.Context().GracefulTUSManager.IsReceivingRequest() {
+		t.Error("the second server stopped admitting uploads")
+	}
+	res, err := http.Get(url + app.HealthzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET %s on the second server = %d, want %d", app.HealthzPath, res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestCancelDrain(t *testing.T) {
+	s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+		cfg.AdminToken = "admin"
+	})
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer admin"}
+	// The running upload keeps the server draining.
+	s.CreateUpload(t, 10)
+	s.Shutdown(t)
+	if res := s.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Length": "10"}, nil); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("POST /files during the drain = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	if res := s.Do(t, http.MethodPost, app.LifecycleResumePath, nil, nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("POST %s without the token = %d, want %d", app.LifecycleResumePath, res.StatusCode, http.StatusUnauthorized)
+	}
+	if res := s.Do(t, http.MethodPost, app.LifecycleResumePath, admin, nil); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST %s = %d, want %d", app.LifecycleResumePath, res.StatusCode, http.StatusAccepted)
+	}
+	s.CreateUpload(t, 10)
+	if s.Exited() {
+		t.Fatal("the server exited after the drain was canceled")
+	}
+	if res := s.Do(t, http.MethodPost, app.LifecycleResumePath, admin, nil); res.StatusCode != http.StatusConflict {
+		t.Errorf("POST %s while serving = %d, want %d", app.LifecycleResumePath, res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestControlWithoutAdminToken(t *testing.T) {
+	s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+		cfg.JournalPath = filepath.Join(cfg.Dir, "upload.journal")
+	})
+	upload := s.CreateUpload(t, 10)
+	// Nothing changes the server over HTTP without the token, nor are the
+	// upload IDs streamed.
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, app.LifecycleResumePath},
+		{http.MethodDelete, app.InterruptedPath + "/upload/" + path.Base(upload)},
+		{http.MethodGet, app.EventsPath},
+	} {
+		if res := s.Do(t, req.method, req.path, nil, nil); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s = %d, want %d", req.method, req.path, res.StatusCode, http.StatusNotFound)
+		}
+	}
+	if res := s.Do(t, http.MethodGet, app.LifecyclePath, nil, nil); res.StatusCode != http.StatusOK {
+		t.Errorf("GET %s = %d, want %d", app.LifecyclePath, res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestShedUploads(t *testing.T) {
+	tests := []struct {
+		name       string
+		pressure   app.PressureConfig
+		wantStatus int
+		wantReason string
+	}{
+		{name: "disk", pressure: app.PressureConfig{DiskMargin: 1 << 62}, wantStatus: http.StatusInsufficientStorage, wantReason: app.ReasonDisk},
+		{name: "uploads", pressure: app.PressureConfig{MaxUploads: 1}, wantStatus: http.StatusServiceUnavailable, wantReason: app.ReasonUploads},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+				cfg.Pressure = tt.pressure
+			})
+			if tt.pressure.MaxUploads > 0 {
+				s.CreateUpload(t, 10)
+			}
+			res := s.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Length": "10"}, nil)
+			var rej app.Rejection
+			if err := json.NewDecoder(res.Body).Decode(&rej); err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.wantStatus || rej.Reason != tt.wantReason {
+				t.Errorf("POST /files = %d %+v, want %d with reason %q", res.StatusCode, rej, tt.wantStatus, tt.wantReason)
+			}
+			if res.Header.Get("Retry-After") == "" {
+				t.Error("no Retry-After on the shed upload")
+			}
+		})
+	}
+}
+
+func TestSignalPolicy(t *testing.T) {
+	s := gracefultest.StartTUS(t)
+	s.CreateUpload(t, 10)
+
+	// SIGHUP is ignored, the server keeps admitting uploads.
+	s.Signals.Send(t, syscall.SIGHUP)
+	s.CreateUpload(t, 10)
+	if s.Exited() || !s.Manager.DrainStartedAt().IsZero() {
+		t.Fatal("SIGHUP shut the server down")
+	}
+
+	// SIGQUIT stops without waiting for the running upload.
+	s.Signals.Send(t, syscall.SIGQUIT)
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitForced {
+		t.Errorf("exit code = %d, want %d", code, app.ExitForced)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+		cfg.AdminToken = "admin"
+	})
+	if res := s.Do(t, http.MethodGet, app.EventsPath, nil, nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET %s without the token = %d, want %d", app.EventsPath, res.StatusCode, http.StatusUnauthorized)
+	}
+	res := s.Do(t, http.MethodGet, app.EventsPath, map[string]string{echo.HeaderAuthorization: "Bearer admin"}, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d", app.EventsPath, res.StatusCode)
+	}
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if typ := strings.TrimPrefix(scanner.Text(), "event: "); typ != scanner.Text() {
+				events <- typ
+			}
+		}
+	}()
+
+	upload := s.CreateUpload(t, 5)
+	s.Shutdown(t)
+	if code := s.Patch(t, upload, 0, []byte("01234")); code != http.StatusNoContent {
+		t.Fatalf("PATCH during the drain = %d, want %d", code, http.StatusNoContent)
+	}
+
+	// The stream ends with the drain, it does not hold the shutdown.
+	var got []string
+	for typ := range events {
+		got = append(got, typ)
+	}
+	want := []string{"started", "item_begun", "admission_stopped", "item_finished", "drain_completed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code = %d, want %d", code, app.ExitClean)
+	}
+}
+
+func TestCoordinatedDrain(t *testing.T) {
+	coordinator := app.NewMemoryCoordinator(1)
+	withCoordinator := func(cfg *tus.Config) {
+		cfg.Coordinator = coordinator
+	}
+	first := gracefultest.StartTUS(t, withCoordinator)
+	second := gracefultest.StartTUS(t, withCoordinator)
+	firstUpload := first.CreateUpload(t, 5)
+	secondUpload := second.CreateUpload(t, 5)
+
+	first.Shutdown(t)
+	second.Signals.Send(t, syscall.SIGTERM)
+	waitLifecycle(t, second, "queued")
+	// The queued node keeps admitting uploads while the first one drains.
+	if res := first.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Length": "10"}, nil); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST /files on the draining node = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	second.CreateUpload(t, 10)
+
+	if code := first.Patch(t, firstUpload, 0, []byte("01234")); code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := app.ExitCode(first.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code of the first node = %d, want %d", code, app.ExitClean)
+	}
+	waitLifecycle(t, second, "draining")
+	if code := second.Patch(t, secondUpload, 0, []byte("01234")); code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+	}
+}
+
+// waitLifecycle polls the lifecycle of s until it is in state.
+func waitLifecycle(t *testing.T, s *gracefultest.TUS, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status app.LifecycleStatus
+		res := s.Do(t, http.MethodGet, app.LifecyclePath, nil, nil)
+		err := json.NewDecoder(res.Body).Decode(&status)
+		res.Body.Close()
+		if err == nil && status.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lifecycle state = %q, want %q", status.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStoreConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		store tus.StoreConfig
+	}{
+		{name: "unknown backend", store: tus.StoreConfig{Backend: "ftp"}},
+		{name: "s3 without a bucket", store: tus.StoreConfig{Backend: tus.StoreS3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tus.DefaultConfig()
+			cfg.Dir = t.TempDir()
+			cfg.Telemetry = false
+			cfg.Store = tt.store
+			if _, err := tus.New(tus.NewContext(cfg), cfg); err == nil {
+				t.Error("New succeeded")
+			}
+		})
+	}
+}
+
+func TestUploadTTLOptIn(t *testing.T) {
+	t.Setenv("GRACEFUL_UPLOAD_TTL", "")
+	if ttl := tus.DefaultConfig().UploadTTL; ttl != 0 {
+		t.Errorf("UploadTTL without GRACEFUL_UPLOAD_TTL = %s, want the janitor disabled", ttl)
+	}
+	t.Setenv("GRACEFUL_UPLOAD_TTL", "24h")
+	if ttl := tus.DefaultConfig().UploadTTL; ttl != 24*time.Hour {
+		t.Errorf("UploadTTL = %s, want 24h", ttl)
+	}
+}
+
+// TestS3Store runs against the MinIO of GRACEFUL_TEST_S3_ENDPOINT, e.g.
+// http://localhost:9000, with the bucket GRACEFUL_TEST_S3_BUCKET and the
+// credentials of AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("GRACEFUL_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("GRACEFUL_TEST_S3_ENDPOINT is not set")
+	}
+	s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+		cfg.Store = tus.StoreConfig{
+			Backend:      tus.StoreS3,
+			Bucket:       os.Getenv("GRACEFUL_TEST_S3_BUCKET"),
+			ObjectPrefix: t.Name(),
+			Endpoint:     endpoint,
+		}
+	})
+	upload := s.CreateUpload(t, 10)
+	if code := s.Patch(t, upload, 0, []byte("01234")); code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+	}
+	s.Shutdown(t)
+	if code := s.Patch(t, upload, 5, []byte("56789")); code != http.StatusNoContent {
+		t.Fatalf("PATCH during the drain = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code = %d, want %d", code, app.ExitClean)
+	}
+}
+
+func TestConcurrentPatchLocked(t *testing.T) {
+	for _, backend := range []string{tus.LockerMemory, tus.LockerFile} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+				cfg.Locker.Backend = backend
+			})
+			upload := s.CreateUpload(t, 10)
+
+			// The first PATCH holds the lock while its body is being sent.
+			body, w := io.Pipe()
+			req, err := http.NewRequest(http.MethodPatch, s.URL+upload, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Tus-Resumable", "1.0.0")
+			req.Header.Set("Upload-Offset", "0")
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			done := make(chan *http.Response, 1)
+			go func() {
+				res, err := s.Client.Do(req)
+				if err != nil {
+					t.Error(err)
+				}
+				done <- res
+			}()
+			w.Write([]byte("012"))
+			deadline := time.Now().Add(5 * time.Second)
+			for len(s.Manager.HeldLocks()) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("the PATCH did not lock the upload")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if code := s.Patch(t, upload, 0, []byte("01234")); code != http.StatusLocked {
+				t.Errorf("concurrent PATCH = %d, want %d", code, http.StatusLocked)
+			}
+			w.Close()
+			if res := <-done; res != nil && res.StatusCode != http.StatusNoContent {
+				t.Errorf("first PATCH = %d, want %d", res.StatusCode, http.StatusNoContent)
+			}
+			if locks := s.Manager.HeldLocks(); len(locks) != 0 {
+				t.Errorf("HeldLocks = %v after the PATCH", locks)
+			}
+			if code := s.Patch(t, upload, 3, []byte("3456789")); code != http.StatusNoContent {
+				t.Errorf("PATCH after the release = %d, want %d", code, http.StatusNoContent)
+			}
+		})
+	}
+}
+
+func TestTerminateUpload(t *testing.T) {
+	s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+		cfg.AdminToken = "admin"
+	})
+	create := func() (string, string) {
+		res := s.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Length": "10"}, nil)
+		loc, err := res.Location()
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := res.Header.Get(app.TerminationTokenHeader)
+		if token == "" {
+			t.Fatalf("POST /files answered without %s", app.TerminationTokenHeader)
+		}
+		return loc.Path, token
+	}
+	first, firstToken := create()
+	second, _ := create()
+	s.Shutdown(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{name: "no token", path: first, want: http.StatusForbidden},
+		{name: "token of another upload", path: second, header: map[string]string{app.TerminationTokenHeader: firstToken}, want: http.StatusForbidden},
+		{name: "own token", path: first, header: map[string]string{app.TerminationTokenHeader: firstToken}, want: http.StatusNoContent},
+		{name: "admin", path: second, header: map[string]string{echo.HeaderAuthorization: "Bearer admin"}, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if res := s.Do(t, http.MethodDelete, tt.path, tt.header, nil); res.StatusCode != tt.want {
+			t.Errorf("%s: DELETE = %d, want %d", tt.name, res.StatusCode, tt.want)
+		}
+	}
+	// The terminated uploads no longer hold the drain.
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code = %d, want %d", code, app.ExitClean)
+	}
+}
+
+func TestConcatenation(t *testing.T) {
+	s := gracefultest.StartTUS(t)
+	partial := func() string {
+		res := s.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Length": "5", "Upload-Concat": "partial"}, nil)
+		loc, err := res.Location()
+		if err != nil {
+			t.Fatalf("POST partial upload = %d, err=%v", res.StatusCode, err)
+		}
+		return loc.Path
+	}
+	first, second := partial(), partial()
+	if code := s.Patch(t, first, 0, []byte("01234")); code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+	}
+
+	s.Shutdown(t)
+	if code := s.Patch(t, second, 0, []byte("56789")); code != http.StatusNoContent {
+		t.Fatalf("PATCH during the drain = %d, want %d", code, http.StatusNoContent)
+	}
+	// Both parts are complete, the drain waits for the final upload.
+	s.Do(t, http.MethodHead, first, nil, nil)
+	if s.Exited() {
+		t.Fatal("the server exited before the final upload")
+	}
+	res := s.Do(t, http.MethodPost, "/files", map[string]string{"Upload-Concat": "final;" + first + " " + second}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST final upload during the drain = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code = %d, want %d", code, app.ExitClean)
+	}
+}
+
+func TestUploadExpiration(t *testing.T) {
+	var dir string
+	s := gracefultest.StartTUS(t, func(cfg *tus.Config) {
+		dir = cfg.Dir
+		cfg.UploadTTL = time.Hour
+		cfg.JanitorInterval = time.Minute
+		cfg.StaleUploadAfter = 2 * time.Minute
+	})
+	// The uploads were created before the clock of the test, beyond the TTL.
+	created := s.Clock.Now().Add(-2 * time.Hour)
+	age := func(upload string) {
+		info := filepath.Join(dir, path.Base(upload)+".info")
+		if err := os.Chtimes(info, created, created); err != nil {
+			t.Fatal(err)
+		}
+	}
+	abandoned := s.CreateUpload(t, 10)
+	if code := s.Patch(t, abandoned, 0, []byte("01234")); code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+	}
+	complete := s.CreateUpload(t, 3)
+	if code := s.Patch(t, complete, 0, []byte("012")); code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d, want %d", code, http.StatusNoContent)
+	}
+	// An upload left by a previous process is tracked by no one.
+	previous := filepath.Join(dir, "previous")
+	if err := os.WriteFile(previous+".info", []byte(`{"ID":"previous","Size":10}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(previous, []byte("01"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	age(abandoned)
+	age(complete)
+	age(previous)
+
+	res := s.Do(t, http.MethodHead, abandoned, nil, nil)
+	if got, want := res.Header.Get("Upload-Expires"), created.Add(time.Hour).Format(http.TimeFormat); got != want {
+		t.Errorf("Upload-Expires = %q, want %q", got, want)
+	}
+	if got := s.Do(t, http.MethodHead, complete, nil, nil).Header.Get("Upload-Expires"); got != "" {
+		t.Errorf("Upload-Expires of the complete upload = %q, want none", got)
+	}
+
+	exists := func(upload string) bool {
+		_, err := os.Stat(filepath.Join(dir, path.Base(upload)+".info"))
+		return err == nil
+	}
+	// The upload of the previous process goes with the first sweep, the
+	// abandoned one is kept while it runs, even once stale, as its client
+	// may still resume it.
+	s.Clock.WaitTimers(t, 1)
+	s.Clock.Advance(time.Minute)
+	s.Clock.WaitTimers(t, 1)
+	if exists(previous) {
+		t.Error("the janitor kept the upload of the previous process")
+	}
+	s.Clock.Advance(time.Minute)
+	s.Clock.WaitTimers(t, 1)
+	if !exists(abandoned) {
+		t.Error("the janitor removed a running upload")
+	}
+	if !exists(complete) {
+		t.Error("the janitor removed the complete upload")
+	}
+	if n := s.Manager.Metrics().ExpiredUploads(); n != 1 {
+		t.Errorf("ExpiredUploads = %d, want 1", n)
+	}
+	if code := s.Do(t, http.MethodHead, "/files/previous", nil, nil).StatusCode; code != http.StatusNotFound {
+		t.Errorf("HEAD of the removed upload = %d, want %d", code, http.StatusNotFound)
+	}
+	// The stale upload does not hold the drain.
+	s.Shutdown(t)
+	if code := app.ExitCode(s.Wait(t)); code != app.ExitClean {
+		t.Errorf("exit code = %d, want %d", code, app.ExitClean)
+	}
+}